@@ -4,6 +4,7 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -37,7 +38,7 @@ func MigrateCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 		if err != nil {
 			return nil, err
 		}
-		if w.LogFunc == nil {
+		if w.LogFunc == nil && w.Logger == nil {
 			w.LogFunc = cmd.Println
 		}
 		return w, nil
@@ -51,6 +52,8 @@ func MigrateCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 	cmd.AddCommand(unlockCommand(ctx, f2))
 	cmd.AddCommand(listCommand(ctx, f2))
 	cmd.AddCommand(showCommand(ctx, f2))
+	cmd.AddCommand(statusCommand(ctx, f2))
+	cmd.AddCommand(infoCommand(ctx, f2))
 	return cmd
 }
 
@@ -72,23 +75,60 @@ func upCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 }
 
 func downCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
+	var flags struct {
+		all bool
+	}
 	cmd := &cobra.Command{
 		Short:   "migrate down",
-		Long:    "rollback all database migrations",
-		Use:     "down",
-		PreRunE: cobra.NoArgs,
+		Long:    "rollback the last count database migrations (default 1)",
+		Use:     "down [count]",
+		PreRunE: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			count := 1
+			if len(args) > 0 {
+				if flags.all {
+					return fmt.Errorf("cannot specify count with --all")
+				}
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n <= 0 {
+					return fmt.Errorf("invalid count: %s", args[0])
+				}
+				count = n
+			}
 			m, err := f()
 			if err != nil {
 				return err
 			}
-			return m.Down(ctx)
+			if flags.all {
+				return m.Down(ctx)
+			}
+			n, err := m.Steps(ctx, -count)
+			if err != nil {
+				return err
+			}
+			if n < count {
+				// Steps stops without error at a locked version
+				applied, err := m.Applied(ctx)
+				if err != nil {
+					return err
+				}
+				if len(applied) > 0 && applied[len(applied)-1].Locked {
+					// the error is expected, so do not print usage
+					cmd.SilenceUsage = true
+					return &migration.LockedError{Version: applied[len(applied)-1].ID}
+				}
+			}
+			return nil
 		},
 	}
+	cmd.Flags().BoolVar(&flags.all, "all", false, "rollback all database migrations")
 	return cmd
 }
 
 func gotoCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
+	var flags struct {
+		dryRun bool
+	}
 	cmd := &cobra.Command{
 		Short:   "migrate to version",
 		Long:    "migrate up or down to a specific version",
@@ -103,9 +143,13 @@ func gotoCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if flags.dryRun {
+				m.DryRun = true
+			}
 			return m.Goto(ctx, id)
 		},
 	}
+	cmd.Flags().BoolVarP(&flags.dryRun, "dry-run", "n", false, "log migrations without performing them")
 	return cmd
 }
 
@@ -194,11 +238,17 @@ func showCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 			cmd.Printf("version %d:", id)
 			if ver.Failed {
 				cmd.Print(" FAILED")
+				if ver.FailedStatement > 0 {
+					cmd.Printf(" at statement %d", ver.FailedStatement)
+				}
 			}
 			if ver.Locked {
 				cmd.Print(" Locked")
 			}
 			cmd.Println()
+			if ver.AppliedBy != "" {
+				cmd.Printf("applied by %s\n", ver.AppliedBy)
+			}
 			cmd.Println("Up\n--")
 			cmd.Println(strings.TrimSpace(ver.Up))
 			cmd.Println("\nDown\n----")
@@ -212,7 +262,8 @@ func showCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 
 func listCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 	var flags struct {
-		all bool
+		all    bool
+		output string
 	}
 	cmd := &cobra.Command{
 		Short:   "list versions",
@@ -220,6 +271,9 @@ func listCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 		Use:     "list",
 		PreRunE: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkOutput(flags.output); err != nil {
+				return err
+			}
 			m, err := f()
 			if err != nil {
 				return err
@@ -248,6 +302,9 @@ func listCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 				}
 				versions = vcopy
 			}
+			if flags.output == outputJSON {
+				return writeJSON(cmd, versions)
+			}
 
 			w := tablewriter.NewWriter(cmd.OutOrStderr())
 			w.SetHeader([]string{"id", "applied", "status"})
@@ -275,9 +332,152 @@ func listCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
 		},
 	}
 	cmd.Flags().BoolVarP(&flags.all, "all", "a", false, "list all versions")
+	addOutputFlag(cmd, &flags.output)
 	return cmd
 }
 
+func statusCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
+	var flags struct {
+		output string
+	}
+	cmd := &cobra.Command{
+		Short:   "show migration status",
+		Long:    "list all database versions, and exit with an error if any are pending",
+		Use:     "status",
+		PreRunE: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkOutput(flags.output); err != nil {
+				return err
+			}
+			m, err := f()
+			if err != nil {
+				return err
+			}
+			versions, err := m.Versions(ctx)
+			if err != nil {
+				return err
+			}
+			status, err := m.Status(ctx)
+			if err != nil {
+				return err
+			}
+
+			if flags.output == outputJSON {
+				output := struct {
+					*migration.Status
+					Versions []*migration.Version
+				}{
+					Status:   status,
+					Versions: versions,
+				}
+				if err := writeJSON(cmd, output); err != nil {
+					return err
+				}
+			} else {
+				w := tablewriter.NewWriter(cmd.OutOrStderr())
+				w.SetHeader([]string{"version", "applied at", "status", "locked", "failed"})
+				for _, ver := range versions {
+					var row []string
+					row = append(row, fmt.Sprint(ver.ID))
+					if ver.AppliedAt == nil {
+						row = append(row, "", "pending")
+					} else {
+						row = append(row, (*ver.AppliedAt).Format(time.RFC3339), "applied")
+					}
+					row = append(row, yesNo(ver.Locked), yesNo(ver.Failed))
+					w.Append(row)
+				}
+				w.Render()
+				cmd.Printf("current version %d, latest version %d\n", status.CurrentVersion, status.LatestVersion)
+			}
+
+			if status.PendingCount > 0 {
+				// the error is expected, so do not print usage
+				cmd.SilenceUsage = true
+				return fmt.Errorf("%d pending migrations", status.PendingCount)
+			}
+			return nil
+		},
+	}
+	addOutputFlag(cmd, &flags.output)
+	return cmd
+}
+
+func infoCommand(ctx context.Context, f NewWorkerFunc) *cobra.Command {
+	var flags struct {
+		output string
+	}
+	cmd := &cobra.Command{
+		Short:   "show database capabilities",
+		Long:    "show the features of the database that affect how migrations are performed",
+		Use:     "info",
+		PreRunE: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkOutput(flags.output); err != nil {
+				return err
+			}
+			m, err := f()
+			if err != nil {
+				return err
+			}
+			c, err := m.Capabilities(ctx)
+			if err != nil {
+				return err
+			}
+			if flags.output == outputJSON {
+				return writeJSON(cmd, c)
+			}
+			w := tablewriter.NewWriter(cmd.OutOrStderr())
+			w.SetHeader([]string{"capability", "supported"})
+			w.Append([]string{"transactional ddl", yesNo(c.TransactionalDDL)})
+			w.Append([]string{"advisory locks", yesNo(c.AdvisoryLocks)})
+			w.Append([]string{"drop if exists", yesNo(c.IfExists)})
+			w.Append([]string{"drop index on table", yesNo(c.DropIndexOnTable)})
+			w.Append([]string{"drop trigger by name", yesNo(c.DropTriggerByName)})
+			w.Append([]string{"multiple statements", yesNo(c.MultipleStatements)})
+			w.Append([]string{"schema-qualified tables", yesNo(c.SchemaQualifiedTables)})
+			w.Append([]string{"search path", yesNo(c.SearchPath)})
+			w.Append([]string{"database clock", yesNo(c.DatabaseClock)})
+			w.Render()
+			return nil
+		},
+	}
+	addOutputFlag(cmd, &flags.output)
+	return cmd
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return ""
+}
+
+// Output formats for the --output flag.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+func addOutputFlag(cmd *cobra.Command, output *string) {
+	cmd.Flags().StringVarP(output, "output", "o", outputTable, "output format: table or json")
+}
+
+func checkOutput(output string) error {
+	switch output {
+	case outputTable, outputJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid output format: %s", output)
+}
+
+// writeJSON writes v as indented JSON to standard output.
+func writeJSON(cmd *cobra.Command, v interface{}) error {
+	enc := json.NewEncoder(cmd.OutOrStdout())
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
 func parseVersion(s string) (migration.VersionID, error) {
 	n, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
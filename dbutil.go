@@ -5,7 +5,9 @@ import "time"
 // timeVal implements the sql.Scanner method, and is a forgiving
 // scanner for time values. This is useful when working with sqlite,
 // which stores time values as text or int64. (It also supports
-// float64, but this little type doesn't).
+// float64, but this little type doesn't). It is also useful with
+// MySQL, which returns datetime values as []byte unless the DSN
+// specifies parseTime=true.
 type timeVal struct {
 	Time time.Time
 }
@@ -16,6 +18,10 @@ func (tv *timeVal) Scan(src interface{}) error {
 		return nil
 	}
 
+	if b, ok := src.([]byte); ok {
+		src = string(b)
+	}
+
 	switch v := src.(type) {
 	case time.Time:
 		tv.Time = v
@@ -23,6 +29,7 @@ func (tv *timeVal) Scan(src interface{}) error {
 	case string:
 		for _, format := range []string{
 			"2006-01-02 15:04:05Z07:00", // sqlite
+			"2006-01-02 15:04:05",       // mysql
 			time.RFC3339,
 			time.RFC3339Nano,
 		} {
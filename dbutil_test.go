@@ -34,6 +34,10 @@ func TestTimeVal(t *testing.T) {
 			src:  "2199-12-31 23:59:59+00:00",
 			want: "2199-12-31T23:59:59Z",
 		},
+		{
+			src:  []byte("2099-12-31 23:59:59"),
+			want: "2099-12-31T23:59:59Z",
+		},
 		{
 			src:  int64(1000000000),
 			want: time.Unix(1000000000, 0).UTC().Format(time.RFC3339),
@@ -0,0 +1,964 @@
+package migration
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// dbObjectType is the type of database object affected by a DDL statement.
+type dbObjectType string
+
+// Database object types recognized by the DDL parser.
+const (
+	dbObjectTypeTable     dbObjectType = "table"
+	dbObjectTypeSequence  dbObjectType = "sequence"
+	dbObjectTypeView      dbObjectType = "view"
+	dbObjectTypeType      dbObjectType = "type"
+	dbObjectTypeExtension dbObjectType = "extension"
+	dbObjectTypeTrigger   dbObjectType = "trigger"
+	dbObjectTypeFunction  dbObjectType = "function"
+	dbObjectTypeProcedure dbObjectType = "procedure"
+	dbObjectTypeSchema    dbObjectType = "schema"
+	dbObjectTypeIndex     dbObjectType = "index"
+
+	dbObjectTypeMaterializedView dbObjectType = "materialized view"
+
+	// columns can only be the subject of "comment on column"
+	dbObjectTypeColumn dbObjectType = "column"
+)
+
+// dbObjectTypes lists the database object types that can be created
+// and dropped using "create <type> <name>" and "drop <type> <name>".
+var dbObjectTypes = []dbObjectType{
+	dbObjectTypeTable,
+	dbObjectTypeSequence,
+	dbObjectTypeView,
+	dbObjectTypeMaterializedView,
+	dbObjectTypeType,
+	dbObjectTypeExtension,
+	dbObjectTypeTrigger,
+	dbObjectTypeFunction,
+	dbObjectTypeProcedure,
+	dbObjectTypeSchema,
+	dbObjectTypeIndex,
+}
+
+// isRestorable reports whether objects of type t are restored to their
+// previous definition by a down migration. Restorable objects, such as
+// views, are typically dropped and recreated rather than altered.
+func isRestorable(t dbObjectType) bool {
+	switch t {
+	case dbObjectTypeView, dbObjectTypeMaterializedView, dbObjectTypeTrigger,
+		dbObjectTypeFunction, dbObjectTypeProcedure:
+		return true
+	}
+	return false
+}
+
+// A ddlAction is a single SQL/DDL statement in an up migration,
+// along with the statements required to reverse it.
+type ddlAction struct {
+	sql        string       // statement text
+	verb       string       // "create", "drop" or "alter", empty if not recognized
+	objectType dbObjectType // type of database object
+	name       string       // name of database object, as written in the statement
+	table      string       // table for a trigger, as written in the statement
+	indexTable string       // table for an index, as written in the statement
+	ifExists   bool         // drop statement specifies "if exists"
+	dropBefore bool         // create statement replaces any existing object, eg "or replace"
+	simpleDrop bool         // drop statement drops a single object, without "cascade"
+	down       []string     // statements that reverse the action, or nil if not reversible
+}
+
+// newDDLActions splits the SQL into statements and determines
+// how to reverse each statement, if possible.
+func newDDLActions(sql string) []*ddlAction {
+	var actions []*ddlAction
+	for _, stmt := range splitStatements(sql) {
+		p := &ddlParser{tokens: tokenize(stmt)}
+		a := &ddlAction{sql: stmt}
+		p.parse(a)
+		actions = append(actions, a)
+	}
+	mergeDropCreate(actions)
+	return actions
+}
+
+// An SQLAction describes a single SQL/DDL statement, as analyzed by
+// AnalyzeSQL. Statements that are not recognized have an empty Verb.
+type SQLAction struct {
+	Index      int    // position of the statement in the SQL, starting at zero
+	SQL        string // statement text, with comments removed
+	Verb       string // "create", "drop", "alter" or "comment"
+	ObjectType string // eg "table", "view", "materialized view"
+	Schema     string // schema qualifying the object name, if any
+	Name       string // object name, as written in the statement
+	Reversible bool   // statement can be reversed automatically
+}
+
+// AnalyzeSQL splits the SQL into statements and reports, for each
+// statement, the database object it affects and whether it can be
+// reversed automatically. It analyzes the SQL in the same way as
+// the down migration is derived for a version that defines an up
+// migration but not a down migration, so it can be used by tools
+// to warn about migrations that need an explicit down migration.
+//
+// Statements that drop and recreate an object, such as a view, are
+// reported as reversible, but the down migration restores the previous
+// definition only if it is available from an earlier version.
+func AnalyzeSQL(sql string) ([]SQLAction, error) {
+	actions := newDDLActions(sql)
+	if len(actions) == 0 {
+		return nil, errors.New("no statements")
+	}
+	result := make([]SQLAction, 0, len(actions))
+	for i, a := range actions {
+		sa := SQLAction{
+			Index:      i,
+			SQL:        a.sql,
+			Verb:       a.verb,
+			ObjectType: string(a.objectType),
+			Name:       a.name,
+			Reversible: a.down != nil,
+		}
+		if parts := splitName(a.name); len(parts) > 1 {
+			sa.Schema = strings.Join(parts[:len(parts)-1], ".")
+			sa.Name = parts[len(parts)-1]
+		}
+		result = append(result, sa)
+	}
+	return result, nil
+}
+
+// A dropStyle specifies how derived down migrations drop database
+// objects, which depends on the database.
+type dropStyle struct {
+	ifExists     bool // drop objects using "drop ... if exists"
+	indexOnTable bool // drop indexes using "drop index ix1 on t1", as in MySQL
+	triggerName  bool // drop triggers by name only, as in SQLite and MySQL
+}
+
+// dropStatement returns the statement that drops the object created
+// by the action, in the specified style. Triggers are dropped using the
+// Postgres syntax, which specifies the table, unless style.triggerName is
+// set, in which case they are dropped by name only. Indexes are dropped
+// using the Postgres and SQLite syntax, which does not specify the table,
+// unless style.indexOnTable is set, in which case they are dropped using
+// the MySQL syntax, which does not support "if exists". Functions and
+// procedures are dropped by name only, so they must not be overloaded.
+func (a *ddlAction) dropStatement(style dropStyle) string {
+	if a.objectType == dbObjectTypeIndex && style.indexOnTable {
+		parts := splitName(a.name)
+		return fmt.Sprintf("drop index %s on %s;", parts[len(parts)-1], a.indexTable)
+	}
+	var clause string
+	if style.ifExists {
+		clause = "if exists "
+	}
+	if a.objectType == dbObjectTypeTrigger && !style.triggerName {
+		return fmt.Sprintf("drop %s %s%s on %s;", a.objectType, clause, a.name, a.table)
+	}
+	return fmt.Sprintf("drop %s %s%s;", a.objectType, clause, a.name)
+}
+
+// sameObject reports whether the actions refer to the same database object.
+func (a *ddlAction) sameObject(b *ddlAction) bool {
+	return a.objectType == b.objectType &&
+		normalizeName(a.name) == normalizeName(b.name) &&
+		normalizeName(a.table) == normalizeName(b.table)
+}
+
+// mergeDropCreate handles the common idiom of dropping an object if it
+// exists, and then creating it later in the same migration:
+//
+//	drop sequence if exists seq1;
+//	create sequence seq1;
+//
+// The drop statement does not need to be reversed, because reversing
+// the create statement drops the object (and restores its previous
+// definition if the object is restorable).
+func mergeDropCreate(actions []*ddlAction) {
+	for i, a := range actions {
+		if a.verb != "drop" || !a.ifExists || a.down != nil {
+			continue
+		}
+		for _, b := range actions[i+1:] {
+			if b.verb == "create" && b.sameObject(a) {
+				a.down = []string{}
+				b.dropBefore = true
+				break
+			}
+		}
+	}
+}
+
+// deriveDownSQL derives the down migration from the SQL for an up
+// migration. It reports an error listing the statements in the up
+// migration that cannot be reversed automatically, if any.
+func deriveDownSQL(sql string) (string, error) {
+	return deriveDownSQLRestore(sql, nil, dropStyle{})
+}
+
+// deriveDownSQLRestore derives the down migration from the SQL for an up
+// migration, where history contains the SQL for the up migrations of all
+// previous versions, in ascending order. If the up migration drops and
+// recreates a restorable object, such as a view, the down migration
+// restores the previous definition of the object from history. Objects
+// are dropped in the specified style: if style.ifExists is set, they are
+// dropped using "drop ... if exists", so that the down migration succeeds
+// if an object has already been dropped.
+func deriveDownSQLRestore(sql string, history []string, style dropStyle) (string, error) {
+	actions := newDDLActions(sql)
+	if len(actions) == 0 {
+		return "", errors.New("no statements")
+	}
+	var (
+		downs        []string
+		irreversible []string // in reverse order
+	)
+	for i := len(actions) - 1; i >= 0; i-- {
+		a := actions[i]
+		if a.verb == "comment" && a.down != nil {
+			if createdBy(actions[:i], a.commentedObject()) {
+				// dropping the object removes the comment
+				continue
+			}
+			if prev := previousComment(a, history); prev != "" {
+				downs = append(downs, prev)
+				continue
+			}
+		}
+		if a.verb == "create" && a.dropBefore && isRestorable(a.objectType) {
+			downs = append(downs, restoreDown(a, history, style)...)
+			continue
+		}
+		if a.verb == "drop" && a.down == nil && a.simpleDrop && isRestorable(a.objectType) {
+			// The object is dropped and not recreated, so the down
+			// migration recreates its most recent definition.
+			if prev := previousDefinition(a, history); prev != "" {
+				downs = append(downs, prev)
+				continue
+			}
+		}
+		if a.down == nil {
+			irreversible = append(irreversible, firstLine(a.sql))
+			continue
+		}
+		if a.verb == "create" {
+			downs = append(downs, a.dropStatement(style))
+			continue
+		}
+		downs = append(downs, a.down...)
+	}
+	switch len(irreversible) {
+	case 0:
+		return strings.Join(downs, "\n"), nil
+	case 1:
+		return "", fmt.Errorf("cannot reverse statement: %s", irreversible[0])
+	}
+	for i, j := 0, len(irreversible)-1; i < j; i, j = i+1, j-1 {
+		irreversible[i], irreversible[j] = irreversible[j], irreversible[i]
+	}
+	return "", fmt.Errorf("cannot reverse statements: %s", strings.Join(irreversible, "; "))
+}
+
+// commentedObject returns an action identifying the object that
+// a comment statement applies to. Column comments apply to the table.
+func (a *ddlAction) commentedObject() *ddlAction {
+	if a.objectType != dbObjectTypeColumn {
+		return &ddlAction{objectType: a.objectType, name: a.name, table: a.table}
+	}
+	parts := splitName(a.name)
+	return &ddlAction{
+		objectType: dbObjectTypeTable,
+		name:       strings.Join(parts[:len(parts)-1], "."),
+	}
+}
+
+// createdBy reports whether one of the actions creates the object.
+func createdBy(actions []*ddlAction, obj *ddlAction) bool {
+	for _, a := range actions {
+		if a.verb == "create" && a.sameObject(obj) {
+			return true
+		}
+	}
+	return false
+}
+
+// previousComment returns the most recent comment statement in history
+// for the same object as the comment action, or an empty string if there
+// is none, or if the object was created after the previous comment.
+func previousComment(a *ddlAction, history []string) string {
+	obj := a.commentedObject()
+	for i := len(history) - 1; i >= 0; i-- {
+		actions := newDDLActions(history[i])
+		for j := len(actions) - 1; j >= 0; j-- {
+			prev := actions[j]
+			if prev.verb == "comment" && prev.sameObject(a) {
+				return prev.sql + ";"
+			}
+			if prev.verb == "create" && prev.sameObject(obj) {
+				return ""
+			}
+		}
+	}
+	return ""
+}
+
+// formatDownSQL formats derived down SQL for display. Each statement
+// starts on a new line, statements are separated by a blank line if
+// any of them span more than one line, and the indentation common to
+// the continuation lines of each statement is removed.
+func formatDownSQL(sql string) string {
+	stmts := splitStatements(sql)
+	sep := "\n"
+	for i, stmt := range stmts {
+		if strings.Contains(stmt, "\n") {
+			sep = "\n\n"
+		}
+		stmts[i] = dedent(stmt) + ";"
+	}
+	return strings.Join(stmts, sep)
+}
+
+// dedent removes the indentation common to all lines after the first
+// line of a statement. The first line has no indentation, because
+// statements are trimmed by splitStatements.
+func dedent(stmt string) string {
+	lines := strings.Split(stmt, "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent <= 0 {
+		return stmt
+	}
+	for i, line := range lines[1:] {
+		if len(line) >= indent {
+			lines[i+1] = line[indent:]
+		} else {
+			lines[i+1] = strings.TrimLeft(line, " \t")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// restoreDown returns the statements that reverse an action that drops
+// and recreates an object. The object is dropped, and then recreated using
+// its most recent definition in history. If there is no previous definition,
+// or the object was subsequently dropped, it is only dropped.
+func restoreDown(a *ddlAction, history []string, style dropStyle) []string {
+	drop := a.dropStatement(style)
+	if prev := previousDefinition(a, history); prev != "" {
+		return []string{drop, prev}
+	}
+	return []string{drop}
+}
+
+// previousDefinition returns the statement that created the object in
+// its most recent definition in history, or an empty string if there is
+// no previous definition, or the object was subsequently dropped.
+func previousDefinition(a *ddlAction, history []string) string {
+	for i := len(history) - 1; i >= 0; i-- {
+		actions := newDDLActions(history[i])
+		for j := len(actions) - 1; j >= 0; j-- {
+			prev := actions[j]
+			if !prev.sameObject(a) {
+				continue
+			}
+			switch prev.verb {
+			case "create":
+				return prev.sql + ";"
+			case "drop":
+				return ""
+			}
+		}
+	}
+	return ""
+}
+
+// requiresNoTx reports whether the SQL contains a statement that cannot
+// be executed inside a transaction, such as "create index concurrently".
+func requiresNoTx(sql string) bool {
+	for _, stmt := range splitStatements(sql) {
+		p := &ddlParser{tokens: tokenize(stmt)}
+		if p.noTx() {
+			return true
+		}
+	}
+	return false
+}
+
+// splitStatements splits the SQL into individual statements, with
+// comments removed. Empty statements are ignored. Semicolons inside
+// string literals, quoted identifiers and dollar-quoted strings do not
+// terminate a statement.
+func splitStatements(sql string) []string {
+	var (
+		stmts []string
+		buf   strings.Builder
+	)
+
+	flush := func() {
+		if stmt := strings.TrimSpace(buf.String()); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+		buf.Reset()
+	}
+
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		if n := quoteLen(sql, i); n > 0 {
+			// quoted text is never split
+			buf.WriteString(sql[i : i+n])
+			i += n - 1
+			continue
+		}
+		switch {
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			// line comment
+			if n := strings.IndexByte(sql[i:], '\n'); n >= 0 {
+				i += n
+				buf.WriteByte('\n')
+			} else {
+				i = len(sql)
+			}
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			// block comment
+			if n := strings.Index(sql[i+2:], "*/"); n >= 0 {
+				i += n + 3
+				buf.WriteByte(' ')
+			} else {
+				i = len(sql)
+			}
+		case c == ';':
+			flush()
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	flush()
+
+	return stmts
+}
+
+// splittable reports whether the SQL can be split by splitStatements and
+// executed one statement at a time without changing its meaning. It cannot
+// be split if it contains a compound statement, such as a trigger or
+// procedure whose body is delimited by BEGIN and END and contains
+// semicolons, or a MySQL conditional comment or optimizer hint, eg
+// "/*!40101 ... */", which splitStatements removes along with the other
+// comments. SQL that cannot be split is executed in a single call.
+func splittable(sql string) bool {
+	for i := 0; i < len(sql); i++ {
+		if n := quoteLen(sql, i); n > 0 {
+			i += n - 1
+			continue
+		}
+		switch {
+		case strings.HasPrefix(sql[i:], "--"):
+			if n := strings.IndexByte(sql[i:], '\n'); n >= 0 {
+				i += n
+			} else {
+				i = len(sql)
+			}
+		case strings.HasPrefix(sql[i:], "/*!") || strings.HasPrefix(sql[i:], "/*+"):
+			return false
+		case strings.HasPrefix(sql[i:], "/*"):
+			if n := strings.Index(sql[i+2:], "*/"); n >= 0 {
+				i += n + 3
+			} else {
+				i = len(sql)
+			}
+		}
+	}
+	for _, stmt := range splitStatements(sql) {
+		// "begin" starting a statement starts a transaction,
+		// anywhere else it starts a compound statement
+		tokens := tokenize(stmt)
+		for _, tok := range tokens[1:] {
+			if strings.EqualFold(tok, "begin") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// tokenize splits a statement into tokens. Each token is either
+// a word (keyword, identifier, literal) or one of the punctuation
+// characters "(", ")" and ",".
+func tokenize(stmt string) []string {
+	var (
+		tokens []string
+		start  = -1
+	)
+
+	for i := 0; i < len(stmt); i++ {
+		c := stmt[i]
+		if n := quoteLen(stmt, i); n > 0 {
+			// quoted text is part of the current token
+			if start < 0 {
+				start = i
+			}
+			i += n - 1
+			continue
+		}
+		isSpace := c == ' ' || c == '\t' || c == '\n' || c == '\r'
+		isPunct := c == '(' || c == ')' || c == ','
+		if isSpace || isPunct {
+			if start >= 0 {
+				tokens = append(tokens, stmt[start:i])
+				start = -1
+			}
+			if isPunct {
+				tokens = append(tokens, stmt[i:i+1])
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, stmt[start:])
+	}
+
+	return tokens
+}
+
+// splitName splits a qualified name into its parts. Quoted parts
+// retain their quotes, eg `"s"."T"` becomes `"s"` and `"T"`.
+func splitName(name string) []string {
+	var (
+		parts []string
+		start int
+	)
+	for i := 0; i < len(name); i++ {
+		if n := quoteLen(name, i); n > 0 {
+			i += n - 1
+			continue
+		}
+		if name[i] == '.' {
+			parts = append(parts, name[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, name[start:])
+}
+
+// normalizeName returns the canonical form of a qualified name, which
+// is used to compare names. Quotes are removed from quoted parts, which
+// are case-sensitive. Unquoted parts are not case-sensitive, and are
+// converted to lower case.
+func normalizeName(name string) string {
+	parts := splitName(name)
+	for i, part := range parts {
+		if n := len(part); n >= 2 && quoteLen(part, 0) == n {
+			q := part[:1]
+			parts[i] = strings.Replace(part[1:n-1], q+q, q, -1)
+		} else {
+			parts[i] = strings.ToLower(part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteLen returns the length of the quoted text starting at s[i],
+// including the quotes, or zero if there is no quoted text at s[i].
+// If the quoted text is not terminated, it extends to the end of s.
+func quoteLen(s string, i int) int {
+	if q := s[i]; q == '\'' || q == '"' || q == '`' {
+		// A quote character is escaped by doubling it. Postgres escape
+		// strings, eg E'text', also permit backslash escapes.
+		escape := q == '\'' && i > 0 && (s[i-1] == 'E' || s[i-1] == 'e') &&
+			(i == 1 || !isIdentChar(s[i-2]))
+		for j := i + 1; j < len(s); j++ {
+			switch {
+			case escape && s[j] == '\\':
+				j++
+			case s[j] == q && j+1 < len(s) && s[j+1] == q:
+				j++
+			case s[j] == q:
+				return j + 1 - i
+			}
+		}
+		return len(s) - i
+	}
+	if s[i] == '$' && (i == 0 || !isIdentChar(s[i-1])) {
+		// Postgres dollar-quoted string, eg $$text$$ or $tag$text$tag$
+		tag := dollarQuoteTag(s[i:])
+		if tag == "" {
+			return 0
+		}
+		if n := strings.Index(s[i+len(tag):], tag); n >= 0 {
+			return len(tag) + n + len(tag)
+		}
+		return len(s) - i
+	}
+	return 0
+}
+
+// dollarQuoteTag returns the dollar-quote tag at the start of s,
+// eg "$$" or "$body$", or an empty string if there is none.
+func dollarQuoteTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == '$' {
+			return s[:i+1]
+		}
+		if !isIdentChar(c) || (i == 1 && c >= '0' && c <= '9') {
+			// not a tag, eg positional parameter $1
+			return ""
+		}
+	}
+	return ""
+}
+
+// isIdentChar reports whether c can appear in an unquoted identifier.
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' ||
+		(c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') ||
+		c >= 0x80
+}
+
+// firstLine returns the first line of the statement, for use
+// in error messages.
+func firstLine(stmt string) string {
+	if n := strings.IndexByte(stmt, '\n'); n >= 0 {
+		return strings.TrimSpace(stmt[:n]) + " ..."
+	}
+	return stmt
+}
+
+// ddlParser is a simple parser that recognizes enough of the
+// DDL syntax to reverse common statements.
+type ddlParser struct {
+	tokens []string
+	pos    int
+}
+
+// accept consumes the next tokens if they match the keywords,
+// ignoring case, and reports whether they match.
+func (p *ddlParser) accept(keywords ...string) bool {
+	if p.pos+len(keywords) > len(p.tokens) {
+		return false
+	}
+	for i, kw := range keywords {
+		if !strings.EqualFold(p.tokens[p.pos+i], kw) {
+			return false
+		}
+	}
+	p.pos += len(keywords)
+	return true
+}
+
+// end reports whether all tokens have been consumed.
+func (p *ddlParser) end() bool {
+	return p.pos >= len(p.tokens)
+}
+
+// name consumes the next token if it is a name, and returns it.
+// Returns an empty string if the next token is not a name.
+func (p *ddlParser) name() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	tok := p.tokens[p.pos]
+	if tok == "(" || tok == ")" || tok == "," {
+		return ""
+	}
+	p.pos++
+	return tok
+}
+
+// skipClause consumes tokens up to and including the next comma
+// that is not enclosed in parentheses. Reports false if the end of
+// the statement is reached.
+func (p *ddlParser) skipClause() bool {
+	var depth int
+	for ; p.pos < len(p.tokens); p.pos++ {
+		switch p.tokens[p.pos] {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case ",":
+			if depth == 0 {
+				p.pos++
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parse parses the statement tokens and populates the action with
+// the details of the statement, including how to reverse it.
+func (p *ddlParser) parse(a *ddlAction) {
+	switch {
+	case p.accept("create"):
+		a.verb = "create"
+		a.dropBefore = p.accept("or", "replace")
+		p.accept("constraint") // create constraint trigger
+		p.accept("unlogged")   // create unlogged table
+		p.accept("unique")     // create unique index
+		a.objectType = p.objectType()
+		if a.objectType == "" {
+			return
+		}
+		if a.objectType == dbObjectTypeIndex {
+			p.accept("concurrently")
+		}
+		// If the object already exists, the statement does nothing, and
+		// dropping the object would not reverse it, so the statement with
+		// "if not exists" cannot be reversed.
+		ifNotExists := p.accept("if", "not", "exists")
+		a.name = p.name()
+		if a.objectType == dbObjectTypeIndex {
+			a.name, a.indexTable = p.indexName(a.name)
+		}
+		if a.objectType == dbObjectTypeTrigger {
+			a.table = p.triggerTable()
+			if a.table == "" {
+				return
+			}
+		}
+		if a.objectType == dbObjectTypeSchema && !p.plainSchema(a.name) {
+			return
+		}
+		if a.name != "" && !ifNotExists {
+			a.down = []string{a.dropStatement(dropStyle{})}
+		}
+	case p.accept("drop"):
+		a.verb = "drop"
+		a.objectType = p.objectType()
+		if a.objectType == dbObjectTypeIndex {
+			p.accept("concurrently")
+		}
+		a.ifExists = p.accept("if", "exists")
+		a.name = p.name()
+		if a.objectType == dbObjectTypeTrigger && p.accept("on") {
+			a.table = p.name()
+		}
+		p.accept("restrict")
+		a.simpleDrop = a.name != "" && p.end()
+	case p.accept("comment", "on"):
+		a.verb = "comment"
+		start := p.pos
+		if p.accept("column") {
+			a.objectType = dbObjectTypeColumn
+		} else {
+			a.objectType = p.objectType()
+		}
+		a.name = p.name()
+		if a.objectType == dbObjectTypeTrigger && p.accept("on") {
+			a.table = p.name()
+		}
+		for !p.end() && !strings.EqualFold(p.tokens[p.pos], "is") {
+			p.pos++
+		}
+		if a.objectType == "" || a.name == "" || p.end() {
+			return
+		}
+		target := strings.Join(p.tokens[start:p.pos], " ")
+		a.down = []string{fmt.Sprintf("comment on %s is null;", target)}
+	case p.accept("alter", "table"):
+		a.verb = "alter"
+		a.objectType = dbObjectTypeTable
+		p.accept("if", "exists")
+		p.accept("only")
+		a.name = p.name()
+		if a.name != "" {
+			a.down = p.alterTableDown(a.name)
+		}
+	}
+}
+
+// noTx reports whether the statement cannot be executed inside
+// a transaction in PostgreSQL.
+func (p *ddlParser) noTx() bool {
+	switch {
+	case p.accept("vacuum"):
+		return true
+	case p.accept("create"):
+		p.accept("unique")
+		return p.accept("index", "concurrently") || p.accept("database")
+	case p.accept("drop"):
+		return p.accept("index", "concurrently") || p.accept("database")
+	case p.accept("reindex"):
+		for ; !p.end(); p.pos++ {
+			if p.accept("concurrently") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// objectType consumes the next token if it is a database object type,
+// and returns it. Returns an empty string if the next token is not a
+// database object type.
+func (p *ddlParser) objectType() dbObjectType {
+	for _, t := range dbObjectTypes {
+		if p.accept(strings.Fields(string(t))...) {
+			return t
+		}
+	}
+	return ""
+}
+
+// indexName returns the name of the index created by a create index
+// statement, given the name as written in the statement, and the name of
+// its table. If the table is qualified by a schema, the index name is
+// qualified by the same schema, because the index is created in the schema
+// of its table. Returns empty strings if the statement does not name the
+// index, eg "create index on t1(name)", in which case the database
+// generates the name, and the statement cannot be reversed.
+func (p *ddlParser) indexName(name string) (string, string) {
+	if name == "" || strings.EqualFold(name, "on") || !p.accept("on") {
+		return "", ""
+	}
+	p.accept("only")
+	table := p.name()
+	if parts := splitName(table); len(splitName(name)) == 1 && len(parts) > 1 {
+		name = strings.Join(parts[:len(parts)-1], ".") + "." + name
+	}
+	return name, table
+}
+
+// plainSchema reports whether a create schema statement creates an empty
+// schema, which can be reversed by dropping it. The schema is dropped
+// without "cascade", so objects created in the schema by the same
+// migration are dropped individually, in reverse order, before the schema
+// is dropped. If the statement creates objects in the schema as part of
+// the same statement, or names the schema after a role, eg "create schema
+// authorization joe", it cannot be reversed.
+func (p *ddlParser) plainSchema(name string) bool {
+	if strings.EqualFold(name, "authorization") {
+		return false
+	}
+	for ; !p.end(); p.pos++ {
+		if p.accept("create") || p.accept("grant") {
+			return false
+		}
+	}
+	return true
+}
+
+// triggerTable consumes the tokens of a create trigger statement up to
+// and including the table name, and returns the table name. Returns an
+// empty string if the table name is not found.
+func (p *ddlParser) triggerTable() string {
+	for !p.end() {
+		if p.accept("on") {
+			return p.name()
+		}
+		p.pos++
+	}
+	return ""
+}
+
+// alterTableDown returns the statements that reverse an alter table
+// statement, or nil if it cannot be reversed. Only add column, add
+// named constraint and rename clauses can be reversed.
+func (p *ddlParser) alterTableDown(table string) []string {
+	if p.accept("rename") {
+		return p.renameDown(table)
+	}
+
+	var downs []string
+	for {
+		if !p.accept("add") {
+			return nil
+		}
+		var down string
+		if p.accept("constraint") {
+			// alter table t add constraint c foreign key|check|unique ...
+			constraint := p.name()
+			if constraint == "" || !p.acceptConstraintType() {
+				return nil
+			}
+			down = fmt.Sprintf("alter table %s drop constraint %s;", table, constraint)
+		} else {
+			p.accept("column")
+			if p.accept("if", "not", "exists") {
+				// the column may have existed before
+				return nil
+			}
+			column := p.name()
+			if column == "" || isConstraintKeyword(column) {
+				return nil
+			}
+			down = fmt.Sprintf("alter table %s drop column %s;", table, column)
+		}
+		downs = append([]string{down}, downs...)
+		if !p.skipClause() {
+			return downs
+		}
+	}
+}
+
+// renameDown returns the statement that reverses an alter table rename
+// statement, or nil if it cannot be reversed.
+func (p *ddlParser) renameDown(table string) []string {
+	if p.accept("to") {
+		// alter table old rename to new: the renamed table remains
+		// in the same schema as the original table
+		newName := p.name()
+		if newName == "" || !p.end() {
+			return nil
+		}
+		var schema string
+		if parts := splitName(table); len(parts) > 1 {
+			schema = strings.Join(parts[:len(parts)-1], ".") + "."
+			table = parts[len(parts)-1]
+		}
+		return []string{fmt.Sprintf("alter table %s%s rename to %s;", schema, newName, table)}
+	}
+
+	// alter table t rename [column] old to new
+	if p.accept("constraint") {
+		return nil
+	}
+	p.accept("column")
+	oldName := p.name()
+	if oldName == "" || !p.accept("to") {
+		return nil
+	}
+	newName := p.name()
+	if newName == "" || !p.end() {
+		return nil
+	}
+	return []string{fmt.Sprintf("alter table %s rename column %s to %s;", table, newName, oldName)}
+}
+
+// acceptConstraintType consumes the next token if it starts the definition
+// of a named table constraint that can be dropped by name.
+func (p *ddlParser) acceptConstraintType() bool {
+	for _, keyword := range []string{"foreign", "check", "unique", "primary", "exclude"} {
+		if p.accept(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// isConstraintKeyword reports whether the word introduces a table
+// constraint or index in an alter table add clause.
+func isConstraintKeyword(word string) bool {
+	switch strings.ToLower(word) {
+	case "constraint", "primary", "unique", "foreign", "check", "index", "key", "exclude":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,807 @@
+package migration
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeriveDownSQL(t *testing.T) {
+	tests := []struct {
+		up   string
+		down string
+		err  string
+	}{
+		{
+			up:   `create table t1(id int primary key, name text);`,
+			down: `drop table t1;`,
+		},
+		{
+			up:   `CREATE TABLE public.t1(id int primary key);`,
+			down: `drop table public.t1;`,
+		},
+		{
+			up:  `CREATE TABLE IF NOT EXISTS public.t1(id int primary key);`,
+			err: "cannot reverse statement: CREATE TABLE IF NOT EXISTS public.t1(id int primary key)",
+		},
+		{
+			up: `
+				-- create two tables
+				create table t1(id int);
+				create table t2(id int); /* trailing comment */
+			`,
+			down: "drop table t2;\ndrop table t1;",
+		},
+		{
+			up: `
+				create schema s1;
+				create table s1.t1(id int primary key);
+				create sequence s1.seq1;
+				create view s1.v1 as select id from s1.t1;
+			`,
+			down: "drop view s1.v1;\ndrop sequence s1.seq1;\ndrop table s1.t1;\ndrop schema s1;",
+		},
+		{
+			up:   `create schema "S1" authorization joe;`,
+			down: `drop schema "S1";`,
+		},
+		{
+			up:  `create schema if not exists s1;`,
+			err: "cannot reverse statement: create schema if not exists s1",
+		},
+		{
+			up:   `drop schema if exists s1; create schema s1;`,
+			down: `drop schema s1;`,
+		},
+		{
+			up:  `create schema authorization joe;`,
+			err: "cannot reverse statement: create schema authorization joe",
+		},
+		{
+			up:  `create schema s1 create table t1(id int) create view v1 as select id from t1;`,
+			err: "cannot reverse statement: create schema s1 create table t1(id int) create view v1 as select id from t1",
+		},
+		{
+			up:  `drop schema s1 cascade;`,
+			err: "cannot reverse statement: drop schema s1 cascade",
+		},
+		{
+			up:   `create table "MyTable"(id int);`,
+			down: `drop table "MyTable";`,
+		},
+		{
+			up:   `create table "s"."My Table"(id int);`,
+			down: `drop table "s"."My Table";`,
+		},
+		{
+			up:   "create table `MyTable`(id int);",
+			down: "drop table `MyTable`;",
+		},
+		{
+			up:   `create table t as select * from s;`,
+			down: `drop table t;`,
+		},
+		{
+			up:   "CREATE UNLOGGED TABLE snap.t(id, name) AS\nSELECT id, name\nFROM s\nWHERE name <> 'as';",
+			down: `drop table snap.t;`,
+		},
+		{
+			up:   `create type mood as enum ('sad', 'ok', 'happy');`,
+			down: `drop type mood;`,
+		},
+		{
+			up:   `CREATE TYPE app.Mood AS ENUM('sad', 'ok', 'happy');`,
+			down: `drop type app.Mood;`,
+		},
+		{
+			up:   `create type "s"."Complex" as (r double precision, i double precision);`,
+			down: `drop type "s"."Complex";`,
+		},
+		{
+			up:   `create type inventory_item as(name text, supplier_id integer, price numeric);`,
+			down: `drop type inventory_item;`,
+		},
+		{
+			up:   `CREATE EXTENSION "uuid-ossp";`,
+			down: `drop extension "uuid-ossp";`,
+		},
+		{
+			up:  `CREATE EXTENSION IF NOT EXISTS "uuid-ossp";`,
+			err: `cannot reverse statement: CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`,
+		},
+		{
+			up:   `create extension hstore with schema public;`,
+			down: `drop extension hstore;`,
+		},
+		{
+			up: `
+				drop extension if exists "uuid-ossp";
+				create extension "uuid-ossp";
+			`,
+			down: `drop extension "uuid-ossp";`,
+		},
+		{
+			up:   `create trigger trg1 before insert or update of name, code on s.t1 for each row execute function f1();`,
+			down: `drop trigger trg1 on s.t1;`,
+		},
+		{
+			up:   `CREATE CONSTRAINT TRIGGER "Trg1" AFTER DELETE ON "T1" DEFERRABLE FOR EACH ROW EXECUTE PROCEDURE f1();`,
+			down: `drop trigger "Trg1" on "T1";`,
+		},
+		{
+			up: `
+				drop trigger if exists trg1 on t1;
+				create trigger trg1 after insert on t1 for each row execute function f1();
+			`,
+			down: `drop trigger trg1 on t1;`,
+		},
+		{
+			up: `
+				drop trigger if exists trg1 on t2;
+				create trigger trg1 after insert on t1 for each row execute function f1();
+			`,
+			err: `cannot reverse statement: drop trigger if exists trg1 on t2`,
+		},
+		{
+			up: `
+				create function f1(a integer) returns integer as $$
+				begin
+					return a + 1; -- increment
+				end;
+				$$ language plpgsql;
+			`,
+			down: `drop function f1;`,
+		},
+		{
+			up:   `CREATE OR REPLACE FUNCTION app."F1"() RETURNS text AS $body$ select 'a;b' $body$ LANGUAGE sql;`,
+			down: `drop function app."F1";`,
+		},
+		{
+			up:   `create procedure p1(a int) language sql as $$ insert into t1 values(a); $$;`,
+			down: `drop procedure p1;`,
+		},
+		{
+			up:   `create view "s"."V1" as select 1 as "ID";`,
+			down: `drop view "s"."V1";`,
+		},
+		{
+			up:   `CREATE VIEW v1 AS SELECT 1;`,
+			down: `drop view v1;`,
+		},
+		{
+			up: `
+				drop view if exists "S".v1;
+				create view "S"."v1" as select 1;
+			`,
+			down: `drop view "S"."v1";`,
+		},
+		{
+			up: `
+				drop view if exists "V1";
+				create view v1 as select 1;
+			`,
+			err: `cannot reverse statement: drop view if exists "V1"`,
+		},
+		{
+			up: `
+				create table t1(id int, name text);
+				comment on table t1 is 'people';
+				comment on column t1.name is 'full name';
+			`,
+			down: `drop table t1;`,
+		},
+		{
+			up:   `COMMENT ON COLUMN s.t1.name IS 'full name';`,
+			down: `comment on COLUMN s.t1.name is null;`,
+		},
+		{
+			up:   `comment on function f1 ( integer ) is 'increment';`,
+			down: `comment on function f1 ( integer ) is null;`,
+		},
+		{
+			up:   `comment on index ix1 is 'lookup by name';`,
+			down: `comment on index ix1 is null;`,
+		},
+		{
+			up:  `comment on rule r1 on t1 is 'not supported';`,
+			err: `cannot reverse statement: comment on rule r1 on t1 is 'not supported'`,
+		},
+		{
+			up:   `create index ix1 on t1(name);`,
+			down: `drop index ix1;`,
+		},
+		{
+			up:   `CREATE UNIQUE INDEX ix1 ON ONLY s1.t1 USING btree (name);`,
+			down: `drop index s1.ix1;`,
+		},
+		{
+			up:   `create index concurrently "Ix1" on "S1"."T1"(name);`,
+			down: `drop index "S1"."Ix1";`,
+		},
+		{
+			up:   `create table t1(id int, name text); create index s1.ix1 on t1(name);`,
+			down: "drop index s1.ix1;\ndrop table t1;",
+		},
+		{
+			up:   `drop index if exists ix1; create index ix1 on t1(name);`,
+			down: `drop index ix1;`,
+		},
+		{
+			up:  `create index if not exists ix1 on t1(name);`,
+			err: "cannot reverse statement: create index if not exists ix1 on t1(name)",
+		},
+		{
+			up:  `create index on t1(name);`,
+			err: "cannot reverse statement: create index on t1(name)",
+		},
+		{
+			up:  `create unique index concurrently on t1(name);`,
+			err: "cannot reverse statement: create unique index concurrently on t1(name)",
+		},
+		{
+			up:  `drop index ix1;`,
+			err: "cannot reverse statement: drop index ix1",
+		},
+		{
+			up:   `alter table "s.x"."T" rename to "U";`,
+			down: `alter table "s.x"."U" rename to "T";`,
+		},
+		{
+			up:   `alter table "T" rename column "A" to "B";`,
+			down: `alter table "T" rename column "B" to "A";`,
+		},
+		{
+			up:   `create or replace view v1 as select 1;`,
+			down: `drop view v1;`,
+		},
+		{
+			up:   `create materialized view mv1 as select 1;`,
+			down: `drop materialized view mv1;`,
+		},
+		{
+			up:   `CREATE MATERIALIZED VIEW "S"."MV1" AS SELECT 1;`,
+			down: `drop materialized view "S"."MV1";`,
+		},
+		{
+			up:   `create sequence seq1;`,
+			down: `drop sequence seq1;`,
+		},
+		{
+			up:   `CREATE SEQUENCE public.seq1 START WITH 100 INCREMENT BY 10;`,
+			down: `drop sequence public.seq1;`,
+		},
+		{
+			up: `
+				drop sequence if exists public.seq1;
+				create sequence public.seq1;
+			`,
+			down: `drop sequence public.seq1;`,
+		},
+		{
+			up: `
+				drop table if exists t1;
+				create table t1(id int);
+			`,
+			down: `drop table t1;`,
+		},
+		{
+			up: `
+				drop sequence seq1;
+				create sequence seq1;
+			`,
+			err: "cannot reverse statement: drop sequence seq1",
+		},
+		{
+			up: `
+				drop sequence if exists seq1;
+				create sequence seq2;
+			`,
+			err: "cannot reverse statement: drop sequence if exists seq1",
+		},
+		{
+			up:   `alter table t1 add column name varchar(30) not null;`,
+			down: `alter table t1 drop column name;`,
+		},
+		{
+			up:   `alter table t1 add name text`,
+			down: `alter table t1 drop column name;`,
+		},
+		{
+			up:  `alter table t1 add column if not exists name text;`,
+			err: "cannot reverse statement: alter table t1 add column if not exists name text",
+		},
+		{
+			up:   `alter table t1 add column price numeric(10,2), add column qty int default 0;`,
+			down: "alter table t1 drop column qty;\nalter table t1 drop column price;",
+		},
+		{
+			up:   `alter table t1 rename to t2;`,
+			down: `alter table t2 rename to t1;`,
+		},
+		{
+			up:   `ALTER TABLE public.t1 RENAME TO t2;`,
+			down: `alter table public.t2 rename to t1;`,
+		},
+		{
+			up:   `alter table t1 rename column name to full_name;`,
+			down: `alter table t1 rename column full_name to name;`,
+		},
+		{
+			up:   `alter table t1 rename name to full_name;`,
+			down: `alter table t1 rename column full_name to name;`,
+		},
+		{
+			up:   "alter table t1 rename to t2;\nalter table t2 rename column a to b;",
+			down: "alter table t2 rename column b to a;\nalter table t2 rename to t1;",
+		},
+		{
+			up:  `alter table t1 rename constraint c1 to c2;`,
+			err: "cannot reverse statement: alter table t1 rename constraint c1 to c2",
+		},
+		{
+			up:   `alter table t1 add column name text default 'a, b', add column c int;`,
+			down: "alter table t1 drop column c;\nalter table t1 drop column name;",
+		},
+		{
+			up:   `alter table t1 add constraint t1_name_uk unique(name);`,
+			down: `alter table t1 drop constraint t1_name_uk;`,
+		},
+		{
+			up:   `alter table t1 add constraint t1_t2_fk foreign key (t2_id) references t2(id) on delete cascade;`,
+			down: `alter table t1 drop constraint t1_t2_fk;`,
+		},
+		{
+			up:   `alter table t1 add constraint t1_qty_ck check (qty > 0 and qty < 100);`,
+			down: `alter table t1 drop constraint t1_qty_ck;`,
+		},
+		{
+			up:   `alter table t1 add column t2_id int, add constraint "T1_T2_FK" foreign key (t2_id) references t2(id);`,
+			down: "alter table t1 drop constraint \"T1_T2_FK\";\nalter table t1 drop column t2_id;",
+		},
+		{
+			up:  `alter table t1 add unique(name);`,
+			err: "cannot reverse statement: alter table t1 add unique(name)",
+		},
+		{
+			up:  `alter table t1 add constraint t1_pk;`,
+			err: "cannot reverse statement: alter table t1 add constraint t1_pk",
+		},
+		{
+			up:  `alter table t1 add column name text, alter column id type bigint;`,
+			err: "cannot reverse statement: alter table t1 add column name text, alter column id type bigint",
+		},
+		{
+			up:  `alter table t1 alter column id type bigint;`,
+			err: "cannot reverse statement: alter table t1 alter column id type bigint",
+		},
+		{
+			up:  `alter table t1 drop column name;`,
+			err: "cannot reverse statement: alter table t1 drop column name",
+		},
+		{
+			up: `create table t1(id int);
+				insert into t1(id)
+				values(1);`,
+			err: "cannot reverse statement: insert into t1(id) ...",
+		},
+		{
+			up:  `create table t1(id int); insert into t1(id) values(1); create view v1 as select 1; delete from t2;`,
+			err: "cannot reverse statements: insert into t1(id) values(1); delete from t2",
+		},
+		{
+			up:  `-- nothing to do`,
+			err: "no statements",
+		},
+	}
+
+	for tn, tt := range tests {
+		down, err := deriveDownSQL(tt.up)
+		if tt.err != "" {
+			if err == nil {
+				t.Errorf("%d: got=nil, want=%v", tn, tt.err)
+			} else if got, want := err.Error(), tt.err; got != want {
+				t.Errorf("%d: got=%v, want=%v", tn, got, want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: got=%v, want=nil", tn, err)
+			continue
+		}
+		if got, want := down, tt.down; got != want {
+			t.Errorf("%d:\ngot=%v\nwant=%v", tn, got, want)
+		}
+	}
+}
+
+func TestAnalyzeSQL(t *testing.T) {
+	actions, err := AnalyzeSQL(`
+		-- comments are removed
+		create table public.t1(id int primary key);
+		alter table t1 add column name text;
+		drop view if exists "S"."V1";
+		create view "S"."V1" as select id from t1;
+		update t1 set name = 'x';
+		drop table t2;
+	`)
+	wantNoError(t, err)
+	want := []SQLAction{
+		{Index: 0, SQL: "create table public.t1(id int primary key)", Verb: "create", ObjectType: "table", Schema: "public", Name: "t1", Reversible: true},
+		{Index: 1, SQL: "alter table t1 add column name text", Verb: "alter", ObjectType: "table", Name: "t1", Reversible: true},
+		{Index: 2, SQL: `drop view if exists "S"."V1"`, Verb: "drop", ObjectType: "view", Schema: `"S"`, Name: `"V1"`, Reversible: true},
+		{Index: 3, SQL: `create view "S"."V1" as select id from t1`, Verb: "create", ObjectType: "view", Schema: `"S"`, Name: `"V1"`, Reversible: true},
+		{Index: 4, SQL: "update t1 set name = 'x'"},
+		{Index: 5, SQL: "drop table t2", Verb: "drop", ObjectType: "table", Name: "t2"},
+	}
+	if got, want := len(actions), len(want); got != want {
+		t.Fatalf("got=%d, want=%d", got, want)
+	}
+	for i := range want {
+		if got, want := actions[i], want[i]; got != want {
+			t.Errorf("%d: got=%+v\nwant=%+v", i, got, want)
+		}
+	}
+
+	_, err = AnalyzeSQL("-- nothing to see here")
+	wantError(t, err, "no statements")
+}
+
+func TestSplittable(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{sql: "create table t1(id int); create table t2(id int);", want: true},
+		{sql: "begin; create table t1(id int); commit;", want: true},
+		{sql: "create function f1() returns int as $$ begin return 1; end; $$ language plpgsql;", want: true},
+		{sql: "insert into t1(name) values('begin; /*! not a comment */');", want: true},
+		{sql: "-- begin /*!\ncreate table t1(id int); /* begin */", want: true},
+		{sql: "create trigger trg1 after insert on t1 for each row begin update t2 set n = 1; end;", want: false},
+		{sql: "create procedure p1() BEGIN select 1; select 2; END;", want: false},
+		{sql: "/*!40101 set names utf8mb4 */; create table t1(id int);", want: false},
+		{sql: "select /*+ max_execution_time(1000) */ id from t1;", want: false},
+	}
+	for tn, tt := range tests {
+		if got, want := splittable(tt.sql), tt.want; got != want {
+			t.Errorf("%d: got=%v, want=%v", tn, got, want)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		sql   string
+		stmts []string
+	}{
+		{
+			sql:   "create table t1(id int); create table t2(id int);",
+			stmts: []string{"create table t1(id int)", "create table t2(id int)"},
+		},
+		{
+			sql: `
+				create function f1() returns integer as $$
+				declare
+					n integer;
+				begin
+					n := 1; -- not a comment
+					return n;
+				end;
+				$$ language plpgsql;
+
+				create function f2() returns integer as $body$
+					begin
+						return $$;$$;
+					end;
+				$body$ language plpgsql;
+			`,
+			stmts: []string{
+				"create function f1() returns integer as $$\n" +
+					"\t\t\t\tdeclare\n" +
+					"\t\t\t\t\tn integer;\n" +
+					"\t\t\t\tbegin\n" +
+					"\t\t\t\t\tn := 1; -- not a comment\n" +
+					"\t\t\t\t\treturn n;\n" +
+					"\t\t\t\tend;\n" +
+					"\t\t\t\t$$ language plpgsql",
+				"create function f2() returns integer as $body$\n" +
+					"\t\t\t\t\tbegin\n" +
+					"\t\t\t\t\t\treturn $$;$$;\n" +
+					"\t\t\t\t\tend;\n" +
+					"\t\t\t\t$body$ language plpgsql",
+			},
+		},
+		{
+			sql:   "prepare p1 as select $1; execute p1(1)",
+			stmts: []string{"prepare p1 as select $1", "execute p1(1)"},
+		},
+		{
+			sql:   `insert into t1(name) values('a; b'); insert into t1(name) values('it''s; here')`,
+			stmts: []string{`insert into t1(name) values('a; b')`, `insert into t1(name) values('it''s; here')`},
+		},
+		{
+			sql:   `insert into t1(name) values(E'it\'s; here'); select 'a\'; select 1`,
+			stmts: []string{`insert into t1(name) values(E'it\'s; here')`, `select 'a\'`, `select 1`},
+		},
+		{
+			sql:   `insert into "t;1"("na""me;") values('-- not a comment /* or this */');`,
+			stmts: []string{`insert into "t;1"("na""me;") values('-- not a comment /* or this */')`},
+		},
+		{
+			sql:   "select $$unterminated; select 1",
+			stmts: []string{"select $$unterminated; select 1"},
+		},
+	}
+
+	for tn, tt := range tests {
+		stmts := splitStatements(tt.sql)
+		if got, want := stmts, tt.stmts; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d:\ngot=%q\nwant=%q", tn, got, want)
+		}
+	}
+}
+
+func TestDeriveDownSQLIfExists(t *testing.T) {
+	tests := []struct {
+		up   string
+		down string
+	}{
+		{
+			up:   `create table t1(id int); alter table t1 add column name text;`,
+			down: "alter table t1 drop column name;\ndrop table if exists t1;",
+		},
+		{
+			up:   `create trigger trg1 after insert on t1 for each row execute function f1();`,
+			down: `drop trigger if exists trg1 on t1;`,
+		},
+		{
+			up:   `create index ix1 on s1.t1(name);`,
+			down: `drop index if exists s1.ix1;`,
+		},
+		{
+			up:   `create or replace view v1 as select 2;`,
+			down: "drop view if exists v1;\ncreate view v1 as select 1;",
+		},
+	}
+	history := []string{`create view v1 as select 1;`}
+	for tn, tt := range tests {
+		down, err := deriveDownSQLRestore(tt.up, history, dropStyle{ifExists: true})
+		if err != nil {
+			t.Errorf("%d: got=%v, want=nil", tn, err)
+			continue
+		}
+		if got, want := down, tt.down; got != want {
+			t.Errorf("%d:\ngot=%v\nwant=%v", tn, got, want)
+		}
+	}
+}
+
+func TestDeriveDownSQLTriggerName(t *testing.T) {
+	tests := []struct {
+		style dropStyle
+		down  string
+	}{
+		{
+			style: dropStyle{},
+			down:  `drop trigger trg1 on t1;`,
+		},
+		{
+			style: dropStyle{ifExists: true},
+			down:  `drop trigger if exists trg1 on t1;`,
+		},
+		{
+			style: dropStyle{triggerName: true},
+			down:  `drop trigger trg1;`,
+		},
+		{
+			style: dropStyle{ifExists: true, triggerName: true},
+			down:  `drop trigger if exists trg1;`,
+		},
+		{
+			// MySQL
+			style: dropStyle{ifExists: true, indexOnTable: true, triggerName: true},
+			down:  `drop trigger if exists trg1;`,
+		},
+	}
+	const up = `create trigger trg1 after insert on t1 for each row execute function f1();`
+	for tn, tt := range tests {
+		down, err := deriveDownSQLRestore(up, nil, tt.style)
+		if err != nil {
+			t.Errorf("%d: got=%v, want=nil", tn, err)
+			continue
+		}
+		if got, want := down, tt.down; got != want {
+			t.Errorf("%d:\ngot=%v\nwant=%v", tn, got, want)
+		}
+	}
+}
+
+func TestDeriveDownSQLIndexOnTable(t *testing.T) {
+	tests := []struct {
+		up   string
+		down string
+	}{
+		{
+			up:   `create table t1(id int, name text); create index ix1 on t1(name);`,
+			down: "drop index ix1 on t1;\ndrop table if exists t1;",
+		},
+		{
+			up:   `create unique index ix1 on s1.t1(name);`,
+			down: `drop index ix1 on s1.t1;`,
+		},
+		{
+			up:   "create index `ix 1` on `t 1`(name);",
+			down: "drop index `ix 1` on `t 1`;",
+		},
+	}
+	style := dropStyle{ifExists: true, indexOnTable: true}
+	for tn, tt := range tests {
+		down, err := deriveDownSQLRestore(tt.up, nil, style)
+		if err != nil {
+			t.Errorf("%d: got=%v, want=nil", tn, err)
+			continue
+		}
+		if got, want := down, tt.down; got != want {
+			t.Errorf("%d:\ngot=%v\nwant=%v", tn, got, want)
+		}
+	}
+}
+
+func TestDeriveDownSQLComment(t *testing.T) {
+	history := []string{
+		`create table t1(id int, name text); comment on table t1 is 'one';`,
+		`comment on table t1 is 'two';`,
+		`create view v1 as select 1; comment on view v1 is 'view';`,
+		`drop view v1; create view v1 as select 2;`,
+	}
+	tests := []struct {
+		up   string
+		down string
+	}{
+		{
+			up:   `comment on table t1 is 'three';`,
+			down: `comment on table t1 is 'two';`,
+		},
+		{
+			// comment removed when the view was recreated
+			up:   `comment on view v1 is 'new view';`,
+			down: `comment on view v1 is null;`,
+		},
+	}
+	for tn, tt := range tests {
+		down, err := deriveDownSQLRestore(tt.up, history, dropStyle{})
+		if err != nil {
+			t.Errorf("%d: got=%v, want=nil", tn, err)
+			continue
+		}
+		if got, want := down, tt.down; got != want {
+			t.Errorf("%d:\ngot=%v\nwant=%v", tn, got, want)
+		}
+	}
+}
+
+func TestDeriveDownSQLDrop(t *testing.T) {
+	history := []string{
+		`create table t1(id int, name text);`,
+		`create view v1 as select id from t1;`,
+		`create view v2 as select 1;`,
+		`alter table t1 add column code text;`,
+		`create or replace view v1 as select id, name from t1;`,
+		`drop view v2;`,
+		`create table t2(id int);`,
+	}
+	tests := []struct {
+		up   string
+		down string
+		err  string
+	}{
+		{
+			// defined several versions earlier
+			up:   `drop view v1;`,
+			down: `create or replace view v1 as select id, name from t1;`,
+		},
+		{
+			up:   `DROP VIEW IF EXISTS V1 RESTRICT;`,
+			down: `create or replace view v1 as select id, name from t1;`,
+		},
+		{
+			up:  `drop view v1; drop table t2;`,
+			err: "cannot reverse statement: drop table t2",
+		},
+		{
+			// already dropped
+			up:  `drop view if exists v2;`,
+			err: "cannot reverse statement: drop view if exists v2",
+		},
+		{
+			// never defined
+			up:  `drop view v3;`,
+			err: "cannot reverse statement: drop view v3",
+		},
+		{
+			up:  `drop view v1 cascade;`,
+			err: "cannot reverse statement: drop view v1 cascade",
+		},
+		{
+			up:  `drop view v1, v2;`,
+			err: "cannot reverse statement: drop view v1, v2",
+		},
+	}
+	for tn, tt := range tests {
+		down, err := deriveDownSQLRestore(tt.up, history, dropStyle{})
+		if tt.err != "" {
+			wantError(t, err, tt.err)
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: got=%v, want=nil", tn, err)
+			continue
+		}
+		if got, want := down, tt.down; got != want {
+			t.Errorf("%d:\ngot=%v\nwant=%v", tn, got, want)
+		}
+	}
+}
+
+func TestFormatDownSQL(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{
+			sql:  "drop table t2;\ndrop table t1;",
+			want: "drop table t2;\ndrop table t1;",
+		},
+		{
+			sql: "drop view v1;\ncreate view v1 as\n\t\t\tselect id\n\t\t\t  , name\n\t\t\tfrom t1;",
+			want: "drop view v1;\n\n" +
+				"create view v1 as\n" +
+				"select id\n" +
+				"  , name\n" +
+				"from t1;",
+		},
+	}
+	for tn, tt := range tests {
+		if got, want := formatDownSQL(tt.sql), tt.want; got != want {
+			t.Errorf("%d:\ngot=%v\nwant=%v", tn, got, want)
+		}
+	}
+}
+
+func TestRequiresNoTx(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{sql: `create index concurrently ix1 on t1(name);`, want: true},
+		{sql: `CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS ix1 ON t1(name)`, want: true},
+		{sql: `drop index concurrently if exists ix1;`, want: true},
+		{sql: `reindex (verbose) index concurrently ix1;`, want: true},
+		{sql: `create table t1(id int); vacuum analyze t1;`, want: true},
+		{sql: `create database db1;`, want: true},
+		{sql: `create index ix1 on t1(name);`, want: false},
+		{sql: `insert into t1(name) values('create index concurrently');`, want: false},
+		{sql: `-- vacuum`, want: false},
+	}
+	for tn, tt := range tests {
+		if got, want := requiresNoTx(tt.sql), tt.want; got != want {
+			t.Errorf("%d: got=%v, want=%v", tn, got, want)
+		}
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "MyTable", want: "mytable"},
+		{name: `"MyTable"`, want: "MyTable"},
+		{name: `Public."MyTable"`, want: "public.MyTable"},
+		{name: `"s.x"."My ""Table"""`, want: `s.x.My "Table"`},
+		{name: "`s`.`T`", want: "s.T"},
+	}
+	for tn, tt := range tests {
+		if got, want := normalizeName(tt.name), tt.want; got != want {
+			t.Errorf("%d: got=%v, want=%v", tn, got, want)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package migration
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 )
 
@@ -10,11 +12,16 @@ import (
 // required to migrate up from the previous version, and the
 // action required to migrate down to the previous version.
 type Definition struct {
-	id         VersionID
-	upAction   Action
-	upCount    int
-	downAction Action
-	downCount  int
+	id          VersionID
+	description string
+	upAction    Action
+	upCount     int
+	downAction  Action
+	downCount   int
+	noTx        bool
+	dependsOn   []VersionID
+	verify      Action
+	verifyCount int
 }
 
 func newDefinition(id VersionID) *Definition {
@@ -23,6 +30,14 @@ func newDefinition(id VersionID) *Definition {
 	}
 }
 
+// Describe provides a short description of the database schema version.
+// The description is stored in the migrations table when the version
+// is applied.
+func (d *Definition) Describe(text string) *Definition {
+	d.description = text
+	return d
+}
+
 // Up defines the SQL to migrate up to the version.
 // Calling this function is identical to calling:
 //  UpAction(Command(sql))
@@ -45,6 +60,10 @@ func (d *Definition) UpAction(a Action) *Definition {
 // Down defines the SQL/DDL to migrate down to the previous version.
 // Calling this method is identical to calling:
 //  DownAction(Command(sql))
+//
+// If the up migration is SQL/DDL that can be reversed automatically,
+// such as "create table" or "alter table ... add column", then the down
+// migration does not need to be defined.
 func (d *Definition) Down(sql string) *Definition {
 	d.downCount++
 	d.downAction = Command(sql)
@@ -61,6 +80,60 @@ func (d *Definition) DownAction(a Action) *Definition {
 	return d
 }
 
+// DependsOn specifies versions that must be applied before this version.
+// Versions are applied in ascending order, except where that would
+// apply a version before one of its dependencies. This is useful when
+// versions are identified by timestamps, and a version depends on a
+// version with a later timestamp that was developed at the same time
+// on another branch. Down migrations are performed in the reverse order.
+//
+// A dependency on an undefined version, or a cycle of dependencies,
+// is reported as an error by Schema.Err.
+func (d *Definition) DependsOn(ids ...VersionID) *Definition {
+	d.dependsOn = append(d.dependsOn, ids...)
+	return d
+}
+
+// Verify defines a check that is performed after the up migration, for
+// example to confirm that a data migration has updated every row. The
+// action must be defined using TxFunc or DBFunc. If the check returns an
+// error, the migration fails.
+//
+// A TxFunc check is performed in the same transaction as the up migration,
+// just before it is committed, so if the check fails, the migration is
+// rolled back. If the up migration is performed outside of a transaction,
+// the check is performed in a separate transaction after the migration,
+// and if it fails, the version is marked as failed.
+//
+// A DBFunc check is performed after the up migration has been committed,
+// so it can check the database in the same way as other users of the
+// database. If the check fails, the version is marked as failed and the
+// database requires manual repair (see Worker.Recover).
+//
+// The check is not performed by down migrations.
+func (d *Definition) Verify(a Action) *Definition {
+	d.verifyCount++
+	d.verify = a
+	return d
+}
+
+// NoTx specifies that the up and down migrations are performed outside
+// of a transaction, even if the database supports transactional DDL.
+// This is necessary for statements such as "vacuum", which cannot be
+// executed inside a transaction. If a migration performed outside of a
+// transaction fails, the version is marked as failed and the database
+// requires manual repair.
+//
+// Migrations containing "create index concurrently" and similar
+// statements are performed outside of a transaction automatically,
+// so NoTx does not need to be called for them. NoTx has no effect
+// on actions defined using TxFunc. Migrations that are always performed
+// outside of a transaction are reported by Version.NoTx.
+func (d *Definition) NoTx() *Definition {
+	d.noTx = true
+	return d
+}
+
 func (d *Definition) errs() Errors {
 	var errs Errors
 
@@ -78,13 +151,14 @@ func (d *Definition) errs() Errors {
 		addError(fmt.Sprintf("up migration defined %d times", d.upCount))
 	}
 
-	if d.downCount == 0 {
-		addError("down migration not defined")
-	}
 	if d.downCount > 1 {
 		addError(fmt.Sprintf("down migration defined %d times", d.downCount))
 	}
 
+	if d.verifyCount > 1 {
+		addError(fmt.Sprintf("verify defined %d times", d.verifyCount))
+	}
+
 	return errs
 }
 
@@ -93,6 +167,27 @@ type action struct {
 	dbFunc   func(context.Context, *sql.DB) error
 	txFunc   func(context.Context, *sql.Tx) error
 	replayUp *VersionID
+	noTx     bool // perform outside of a transaction
+}
+
+// description returns the SQL for the action, or a placeholder
+// if the action is a Go function.
+func (a *action) description() string {
+	if a.dbFunc != nil {
+		return "(DBFunc)"
+	}
+	if a.txFunc != nil {
+		return "(TxFunc)"
+	}
+	return a.sql
+}
+
+// checksum returns a checksum of the action, which is used to detect
+// changes to a migration after it has been applied. Go functions cannot
+// be checksummed, so the checksum only identifies the type of function.
+func (a *action) checksum() string {
+	sum := sha256.Sum256([]byte(a.description()))
+	return hex.EncodeToString(sum[:])
 }
 
 // An Action defines the action performed during an up migration or
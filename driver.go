@@ -3,35 +3,342 @@ package migration
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
-// A driver handles database vendor-specific operations.
-type driver interface {
+// A Driver handles database vendor-specific operations. Drivers for
+// SQLite, Postgres and MySQL are built in. Other drivers can be added
+// using RegisterDriver, or passed to NewWorkerWithDriver.
+//
+// All methods that accept a table name are passed the name of the
+// migrations table, which has been created by CreateMigrationsTable.
+// The name is unquoted, and is either "table" or "schema.table", where
+// each part is a plain identifier. Drivers must quote the name when
+// including it in SQL statements.
+type Driver interface {
+	// SupportsTransactionalDDL reports whether the database can perform
+	// DDL statements inside a transaction, and roll them back if the
+	// transaction is not committed. If it reports false, SQL migrations
+	// are performed outside of a transaction, and a failed migration
+	// requires manual repair. Databases that implicitly commit the
+	// current transaction when a DDL statement is executed (such as MySQL)
+	// must report false.
 	SupportsTransactionalDDL() bool
+
+	// PackageNames returns the names of the Go packages that implement
+	// the database/sql driver for this database. It is used to identify
+	// the built-in drivers, and may return nil for registered drivers.
 	PackageNames() []string
+
+	// CreateMigrationsTable creates the migrations table if it does not
+	// already exist. Columns missing from a table created by an earlier
+	// version of this package should be added.
 	CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string) error
+
+	// MigrationsTableExists reports whether the migrations table exists.
+	// It must not require any privileges other than read access.
+	MigrationsTableExists(ctx context.Context, db *sql.DB, tblname string) (bool, error)
+
+	// InsertVersion inserts a row into the migrations table.
 	InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error
+
+	// DeleteVersion deletes a row from the migrations table.
 	DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error
+
+	// ListVersions returns all rows in the migrations table, in
+	// ascending order of version.
 	ListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error)
+
+	// SetVersionFailed sets the failed status of a version.
 	SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, failed bool) error
+
+	// SetVersionLocked sets the locked status of a version.
 	SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, locked bool) error
+
+	// SetVersionDuration sets the time taken to perform the up migration
+	// for a version.
+	SetVersionDuration(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, d time.Duration) error
+
+	// AcquireLock acquires an exclusive lock keyed on the migrations table
+	// name, which prevents concurrent migrations by multiple processes. It
+	// waits for up to timeout, or indefinitely if timeout is zero, and
+	// returns the connection holding the lock, which is subsequently passed
+	// to ReleaseLock. Drivers that do not support locking return a nil
+	// connection and a nil error.
+	AcquireLock(ctx context.Context, db *sql.DB, tblname string, timeout time.Duration) (*sql.Conn, error)
+
+	// ReleaseLock releases the lock acquired by AcquireLock, and returns
+	// the connection to the pool. The connection may be nil. If the lock
+	// cannot be released, the connection must be discarded rather than
+	// returned to the pool, so that the lock is not held indefinitely.
+	ReleaseLock(ctx context.Context, conn *sql.Conn, tblname string) error
+}
+
+// A MultiStatementDriver is a Driver that reports whether the database
+// can execute multiple SQL statements in a single call to ExecContext.
+// If it reports false, the SQL for each migration is split into individual
+// statements, which are executed one at a time. Drivers that do not
+// implement MultiStatementDriver are assumed to support multiple statements.
+type MultiStatementDriver interface {
+	Driver
+	SupportsMultipleStatements() bool
+}
+
+// A LockingDriver is a Driver that reports whether AcquireLock acquires
+// a lock that prevents concurrent migrations by multiple processes. Drivers
+// that do not implement LockingDriver are assumed not to lock. The built-in
+// drivers implement LockingDriver.
+type LockingDriver interface {
+	Driver
+	SupportsLocking() bool
+}
+
+// A StatementProgressDriver is a Driver that can record which statement
+// failed in a migration that is performed outside of a transaction. This
+// identifies the point at which the database needs to be repaired.
+// The built-in drivers implement StatementProgressDriver.
+type StatementProgressDriver interface {
+	Driver
+
+	// SetVersionFailedStatement records the index (starting at one) of
+	// the statement that failed in the up migration for the version.
+	SetVersionFailedStatement(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, n int) error
+}
+
+// A RangeListDriver is a Driver that can list a range of rows in the
+// migrations table. The rows are returned in ascending order of version,
+// which the worker relies upon. The worker reads the rows one page at a
+// time, so that a large migrations table is not read in a single query.
+// The worker sorts the rows returned by drivers that do not implement
+// RangeListDriver, in case they are not in order. The built-in drivers
+// implement RangeListDriver.
+type RangeListDriver interface {
+	Driver
+
+	// ListVersionsRange returns up to limit rows in the migrations table
+	// with versions greater than after, in ascending order of version.
+	// If limit is zero, there is no limit.
+	ListVersionsRange(ctx context.Context, tx *sql.Tx, tblname string, after VersionID, limit int) ([]*Version, error)
 }
 
-var drivers = []driver{
+// A DropIfExistsDriver is a Driver that reports whether the database
+// supports "drop ... if exists". If it reports true, down migrations
+// derived from the up migration drop objects using "if exists", so that
+// the down migration succeeds if an object has already been dropped,
+// for example after a failed migration has been partly repaired.
+// The built-in drivers implement DropIfExistsDriver.
+type DropIfExistsDriver interface {
+	Driver
+	SupportsDropIfExists() bool
+}
+
+// A DropIndexOnTableDriver is a Driver for a database that requires the
+// table to be specified when dropping an index, eg "drop index ix1 on t1",
+// as MySQL does. If it reports true, down migrations derived from the up
+// migration drop indexes in this form, without "if exists", which is not
+// supported by MySQL. The MySQL driver implements DropIndexOnTableDriver.
+type DropIndexOnTableDriver interface {
+	Driver
+	DropIndexOnTable() bool
+}
+
+// A DropTriggerByNameDriver is a Driver for a database that drops triggers
+// by name only, eg "drop trigger trg1", as SQLite and MySQL do. If it reports
+// true, down migrations derived from the up migration drop triggers in this
+// form, instead of the PostgreSQL form, which specifies the table. The SQLite
+// and MySQL drivers implement DropTriggerByNameDriver.
+type DropTriggerByNameDriver interface {
+	Driver
+	DropTriggerByName() bool
+}
+
+// A DatabaseClockDriver is a Driver that can record the time each version
+// is applied using the database clock instead of the time reported by the
+// worker. See WithDatabaseClock. The built-in drivers implement
+// DatabaseClockDriver.
+type DatabaseClockDriver interface {
+	Driver
+
+	// InsertVersionDatabaseClock inserts a row into the migrations table in
+	// the same way as InsertVersion, except that applied_at is set to the
+	// current time of the database clock, and ver.AppliedAt is updated to
+	// the time recorded.
+	InsertVersionDatabaseClock(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error
+}
+
+// A StoredSQLDriver is a Driver that can store the up and down migrations
+// of each version in the migrations table, so that the database records
+// what was applied. See WithStoredSQL. The built-in drivers implement
+// StoredSQLDriver.
+type StoredSQLDriver interface {
+	Driver
+
+	// AddSQLColumns adds the up_sql and down_sql columns to the migrations
+	// table, if they do not already exist.
+	AddSQLColumns(ctx context.Context, db *sql.DB, tblname string) error
+
+	// SetVersionSQL stores the up and down migrations of a version.
+	SetVersionSQL(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, up string, down string) error
+
+	// ListVersionSQL returns the versions in the migrations table with
+	// only the ID, Up and Down fields set. Up and Down are empty if no
+	// migrations have been stored for a version.
+	ListVersionSQL(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error)
+}
+
+// A SearchPathDriver is a Driver that can set the schema search path
+// for the duration of a transaction. The built-in PostgreSQL driver
+// implements SearchPathDriver. See WithSearchPath.
+type SearchPathDriver interface {
+	Driver
+
+	// SetSearchPath sets the search path to schema until the end of tx.
+	// The schema name has been checked by the worker, but still needs
+	// to be quoted.
+	SetSearchPath(ctx context.Context, tx *sql.Tx, schema string) error
+}
+
+// Capabilities describes the features of the database that affect how
+// migrations are performed. See Worker.Capabilities.
+type Capabilities struct {
+	// TransactionalDDL reports whether DDL statements are performed inside
+	// a transaction, and rolled back if the migration fails. If false, SQL
+	// migrations are performed outside of a transaction, and a failed
+	// migration requires manual repair.
+	TransactionalDDL bool
+
+	// AdvisoryLocks reports whether the migration lock prevents concurrent
+	// migrations by multiple processes. See LockingDriver and
+	// Worker.LockTimeout.
+	AdvisoryLocks bool
+
+	// IfExists reports whether derived down migrations drop objects
+	// using "drop ... if exists". See DropIfExistsDriver.
+	IfExists bool
+
+	// DropIndexOnTable reports whether derived down migrations drop
+	// indexes using "drop index ... on table". See DropIndexOnTableDriver.
+	DropIndexOnTable bool
+
+	// DropTriggerByName reports whether derived down migrations drop
+	// triggers by name only. See DropTriggerByNameDriver.
+	DropTriggerByName bool
+
+	// MultipleStatements reports whether the SQL for a migration is
+	// executed in a single call, rather than one statement at a time.
+	// See MultiStatementDriver and Worker.SplitStatements.
+	MultipleStatements bool
+
+	// SchemaQualifiedTables reports whether the migrations table can be
+	// qualified by a schema, eg "admin.schema_migrations" (for MySQL and
+	// SQLite, the schema is a database). It is always true, because every
+	// driver must accept schema-qualified table names: see Driver.
+	SchemaQualifiedTables bool
+
+	// SearchPath reports whether the schema search path can be set for
+	// migrations. See WithSearchPath.
+	SearchPath bool
+
+	// DatabaseClock reports whether the time each version is applied can
+	// be recorded using the database clock. See WithDatabaseClock.
+	DatabaseClock bool
+}
+
+// A detectingDriver is a Driver that needs to query the database to
+// determine whether a different driver should be used instead. This
+// happens when more than one database uses the same wire protocol.
+type detectingDriver interface {
+	detect(ctx context.Context, db *sql.DB) (Driver, error)
+}
+
+// A poolCheckingDriver is a Driver that can check whether the connection
+// pool is configured correctly for the database. It returns a message
+// describing the problem, or an empty string if there is no problem.
+type poolCheckingDriver interface {
+	checkPool(ctx context.Context, db *sql.DB) string
+}
+
+// errLockTimeout is returned by AcquireLock when the lock
+// is not acquired within the timeout.
+var errLockTimeout = errors.New("lock timeout")
+
+// releaseConn returns the connection holding a session lock to the pool.
+// If err is not nil, the lock may still be held, so the connection is
+// discarded, which ends the database session and releases the lock.
+func releaseConn(conn *sql.Conn, err error) error {
+	if err != nil {
+		conn.Raw(func(interface{}) error {
+			return driver.ErrBadConn
+		})
+	}
+	conn.Close()
+	return err
+}
+
+var drivers = []Driver{
 	&postgres{},
 	&sqlite{},
 	&mysql{},
 }
 
-func findDriver(db *sql.DB) (driver, error) {
+var (
+	registryMu    sync.RWMutex
+	registry      = make(map[string]Driver)       // keyed by name
+	registryTypes = make(map[reflect.Type]Driver) // keyed by database/sql driver type
+)
+
+// RegisterDriver makes a migration driver available for databases opened
+// with the database/sql driver name. A database matches if its database/sql
+// driver has the same type as the driver registered with database/sql under
+// name, or if name is the name of the package that implements its
+// database/sql driver. The database/sql driver must be registered before
+// RegisterDriver is called for its type to be matched. If the same
+// database/sql driver is registered under more than one name, the first
+// migration driver registered for it is used.
+//
+// Registered drivers are consulted before the built-in drivers. If
+// RegisterDriver is called twice with the same name or if drv is nil,
+// it panics.
+func RegisterDriver(name string, drv Driver) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if drv == nil {
+		panic("migration: RegisterDriver driver is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("migration: RegisterDriver called twice for driver " + name)
+	}
+	registry[name] = drv
+
+	// Opening a database does not connect to it, but it provides
+	// access to the database/sql driver registered under name.
+	if sqldb, err := sql.Open(name, ""); err == nil {
+		sqlType := reflect.TypeOf(sqldb.Driver())
+		sqldb.Close()
+		if _, ok := registryTypes[sqlType]; !ok {
+			registryTypes[sqlType] = drv
+		}
+	}
+}
+
+func findDriver(db *sql.DB) (Driver, error) {
 	driverType := reflect.TypeOf(db.Driver()).String()
 	driverType = strings.TrimLeft(driverType, "*")
 	split := strings.SplitN(driverType, ".", 2)
 	pkgname := split[0]
 
+	if drv := findRegisteredDriver(db, pkgname); drv != nil {
+		return drv, nil
+	}
+
 	for _, drv := range drivers {
 		for _, p := range drv.PackageNames() {
 			if p == pkgname {
@@ -43,48 +350,249 @@ func findDriver(db *sql.DB) (driver, error) {
 	return nil, fmt.Errorf("cannot find migration driver for %s", pkgname)
 }
 
+func findRegisteredDriver(db *sql.DB, pkgname string) Driver {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if drv, ok := registry[pkgname]; ok {
+		return drv
+	}
+	return registryTypes[reflect.TypeOf(db.Driver())]
+}
+
 type postgres struct{}
 
 func (w *postgres) PackageNames() []string {
 	return []string{"pq"}
 }
 
+// quote returns the quoted migrations table name. Unquoted identifiers
+// are folded to lower case by PostgreSQL, so the name is folded before
+// quoting to refer to the same table as earlier versions of this package.
+func (w *postgres) quote(tblname string) string {
+	return quoteTableName(strings.ToLower(tblname), `"`)
+}
+
 func (w *postgres) SupportsTransactionalDDL() bool {
 	return true
 }
 
+func (w *postgres) SupportsDropIfExists() bool {
+	return true
+}
+
 func (w *postgres) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string) error {
 	format := `create table if not exists %s` +
 		`(id bigint primary key` +
 		`,applied_at timestamptz not null` +
 		`,failed boolean not null default 'false'` +
 		`,locked boolean not null default 'false'` +
+		`,duration_ms bigint null` +
+		`,description text null` +
+		`,checksum varchar(64) null` +
+		`,failed_statement integer null` +
+		`,applied_by varchar(255) null` +
 		`);`
-	return commonCreateMigrationsTable(ctx, db, tblname, format)
+	if err := commonCreateMigrationsTable(ctx, db, w.quote(tblname), format); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "duration_ms", "bigint null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "description", "text null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "checksum", "varchar(64) null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "failed_statement", "integer null"); err != nil {
+		return err
+	}
+	return commonAddColumn(ctx, db, w.quote(tblname), "applied_by", "varchar(255) null")
+}
+
+func (w *postgres) MigrationsTableExists(ctx context.Context, db *sql.DB, tblname string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `select to_regclass($1) is not null`, w.quote(tblname)).Scan(&exists)
+	if err != nil {
+		return false, wrapf(err, "cannot check for table %s", tblname)
+	}
+	return exists, nil
 }
 
 func (w *postgres) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error {
-	format := `insert into %s(id,applied_at,failed,locked) values($1,$2,$3,$4);`
-	return commonInsertVersion(ctx, tx, tblname, ver, format)
+	format := `insert into %s(id,applied_at,failed,locked,duration_ms,description,checksum,applied_by) values($1,$2,$3,$4,$5,$6,$7,$8);`
+	return commonInsertVersion(ctx, tx, w.quote(tblname), ver, format)
+}
+
+func (w *postgres) InsertVersionDatabaseClock(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error {
+	insertFormat := `insert into %s(id,applied_at,failed,locked,duration_ms,description,checksum,applied_by) values($1,current_timestamp,$2,$3,$4,$5,$6,$7);`
+	selectFormat := `select applied_at from %s where id = $1;`
+	return commonInsertVersionDatabaseClock(ctx, tx, w.quote(tblname), ver, insertFormat, selectFormat)
 }
 
 func (w *postgres) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
 	format := `delete from %s where id = $1;`
-	return commonDeleteVersion(ctx, tx, tblname, id, format)
+	return commonDeleteVersion(ctx, tx, w.quote(tblname), id, format)
 }
 
 func (w *postgres) ListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
-	return commonListVersions(ctx, tx, tblname)
+	return commonListVersions(ctx, tx, w.quote(tblname))
+}
+
+func (w *postgres) ListVersionsRange(ctx context.Context, tx *sql.Tx, tblname string, after VersionID, limit int) ([]*Version, error) {
+	return commonListVersionsRange(ctx, tx, w.quote(tblname), after, limit, "$1")
 }
 
 func (w *postgres) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, failed bool) error {
 	format := `update %s set failed = $1 where id = $2`
-	return commonSetBool(ctx, tx, tblname, id, failed, format)
+	return commonSetBool(ctx, tx, w.quote(tblname), id, failed, format)
 }
 
 func (w *postgres) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, locked bool) error {
 	format := `update %s set locked = $1 where id = $2`
-	return commonSetBool(ctx, tx, tblname, id, locked, format)
+	return commonSetBool(ctx, tx, w.quote(tblname), id, locked, format)
+}
+
+func (w *postgres) SetVersionDuration(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, d time.Duration) error {
+	format := `update %s set duration_ms = $1 where id = $2`
+	return commonSetDuration(ctx, tx, w.quote(tblname), id, d, format)
+}
+
+func (w *postgres) SetVersionFailedStatement(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, n int) error {
+	format := `update %s set failed_statement = $1 where id = $2`
+	return commonSetFailedStatement(ctx, tx, w.quote(tblname), id, n, format)
+}
+
+func (w *postgres) AddSQLColumns(ctx context.Context, db *sql.DB, tblname string) error {
+	return commonAddSQLColumns(ctx, db, w.quote(tblname), "text null")
+}
+
+func (w *postgres) SetVersionSQL(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, up string, down string) error {
+	format := `update %s set up_sql = $1, down_sql = $2 where id = $3`
+	return commonSetVersionSQL(ctx, tx, w.quote(tblname), id, up, down, format)
+}
+
+func (w *postgres) ListVersionSQL(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
+	return commonListVersionSQL(ctx, tx, w.quote(tblname))
+}
+
+func (w *postgres) SetSearchPath(ctx context.Context, tx *sql.Tx, schema string) error {
+	query := "set local search_path to " + w.quote(schema)
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return wrapf(err, "cannot set search_path")
+	}
+	return nil
+}
+
+func (w *postgres) SupportsLocking() bool {
+	return true
+}
+
+func (w *postgres) AcquireLock(ctx context.Context, db *sql.DB, tblname string, timeout time.Duration) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the context deadline enforces the timeout
+	if _, err = conn.ExecContext(ctx, `select pg_advisory_lock($1)`, lockKey(tblname)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (w *postgres) ReleaseLock(ctx context.Context, conn *sql.Conn, tblname string) error {
+	_, err := conn.ExecContext(ctx, `select pg_advisory_unlock($1)`, lockKey(tblname))
+	return releaseConn(conn, err)
+}
+
+// detect queries the database to determine whether it is CockroachDB,
+// which uses the PostgreSQL wire protocol.
+func (w *postgres) detect(ctx context.Context, db *sql.DB) (Driver, error) {
+	var version string
+	if err := db.QueryRowContext(ctx, `select version()`).Scan(&version); err != nil {
+		return nil, wrapf(err, "cannot query database version")
+	}
+	if strings.Contains(version, "CockroachDB") {
+		return &cockroach{}, nil
+	}
+	return w, nil
+}
+
+// cockroach is the driver for CockroachDB. It is selected when a database
+// opened with the PostgreSQL driver reports that it is CockroachDB.
+type cockroach struct {
+	postgres
+}
+
+func (w *cockroach) PackageNames() []string {
+	// only selected by detection
+	return nil
+}
+
+// SupportsTransactionalDDL returns false, because CockroachDB performs
+// schema changes asynchronously after the transaction commits, so a
+// failed schema change cannot be rolled back with the rest of the
+// transaction.
+func (w *cockroach) SupportsTransactionalDDL() bool {
+	return false
+}
+
+func (w *cockroach) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string) error {
+	format := `create table if not exists %s` +
+		`(id int8 primary key` +
+		`,applied_at timestamptz not null` +
+		`,failed bool not null default false` +
+		`,locked bool not null default false` +
+		`,duration_ms int8 null` +
+		`,description string null` +
+		`,checksum string null` +
+		`,failed_statement int8 null` +
+		`,applied_by string null` +
+		`);`
+	if err := commonCreateMigrationsTable(ctx, db, w.quote(tblname), format); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "duration_ms", "int8 null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "description", "string null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "checksum", "string null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "failed_statement", "int8 null"); err != nil {
+		return err
+	}
+	return commonAddColumn(ctx, db, w.quote(tblname), "applied_by", "string null")
+}
+
+func (w *cockroach) MigrationsTableExists(ctx context.Context, db *sql.DB, tblname string) (bool, error) {
+	schema, table := splitTableName(strings.ToLower(tblname))
+	query := `select count(*) from information_schema.tables` +
+		` where table_schema = coalesce(nullif($1, ''), current_schema()) and table_name = $2`
+	var count int
+	if err := db.QueryRowContext(ctx, query, schema, table).Scan(&count); err != nil {
+		return false, wrapf(err, "cannot check for table %s", tblname)
+	}
+	return count > 0, nil
+}
+
+// AcquireLock does not lock, because CockroachDB does not implement
+// advisory locks. Concurrent migrations are detected when inserting
+// into the migrations table, which fails for all but one of them
+// because the version is the primary key.
+func (w *cockroach) AcquireLock(ctx context.Context, db *sql.DB, tblname string, timeout time.Duration) (*sql.Conn, error) {
+	return nil, nil
+}
+
+func (w *cockroach) ReleaseLock(ctx context.Context, conn *sql.Conn, tblname string) error {
+	return nil
+}
+
+func (w *cockroach) SupportsLocking() bool {
+	return false
 }
 
 func wrapf(err error, format string, args ...interface{}) error {
@@ -115,42 +623,155 @@ func (w *sqlite) PackageNames() []string {
 	return []string{"sqlite3"}
 }
 
+// quote returns the quoted migrations table name. SQLite does not
+// have schemas, but a prefix can name an attached database, eg "main".
+func (w *sqlite) quote(tblname string) string {
+	return quoteTableName(tblname, `"`)
+}
+
+// checkPool reports a problem if the database is in memory, and the pool
+// can open more than one connection, because each connection opens a
+// separate, empty database. This does not detect a shared cache in-memory
+// database, which works with more than one connection, so it is only a
+// warning. Errors are ignored, because the check is only advisory.
+func (w *sqlite) checkPool(ctx context.Context, db *sql.DB) string {
+	if db.Stats().MaxOpenConnections == 1 {
+		return ""
+	}
+	var file string
+	row := db.QueryRowContext(ctx, `select file from pragma_database_list where name = 'main'`)
+	if err := row.Scan(&file); err != nil || file != "" {
+		return ""
+	}
+	return "in-memory SQLite database can open more than one connection, " +
+		"each of which is a separate database: call db.SetMaxOpenConns(1)"
+}
+
 func (w *sqlite) SupportsTransactionalDDL() bool {
 	return true
 }
 
+func (w *sqlite) SupportsDropIfExists() bool {
+	return true
+}
+
+func (w *sqlite) DropTriggerByName() bool {
+	return true
+}
+
 func (w *sqlite) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string) error {
 	format := `create table if not exists %s` +
 		`(id integer primary key` +
 		`,applied_at text not null` +
 		`,failed integer not null` +
 		`,locked integer not null` +
+		`,duration_ms integer null` +
+		`,description text null` +
+		`,checksum varchar(64) null` +
+		`,failed_statement integer null` +
+		`,applied_by varchar(255) null` +
 		`);`
-	return commonCreateMigrationsTable(ctx, db, tblname, format)
+	if err := commonCreateMigrationsTable(ctx, db, w.quote(tblname), format); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "duration_ms", "integer null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "description", "text null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "checksum", "varchar(64) null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "failed_statement", "integer null"); err != nil {
+		return err
+	}
+	return commonAddColumn(ctx, db, w.quote(tblname), "applied_by", "varchar(255) null")
+}
+
+func (w *sqlite) MigrationsTableExists(ctx context.Context, db *sql.DB, tblname string) (bool, error) {
+	schema, table := splitTableName(tblname)
+	query := `select count(*) from sqlite_master where type = 'table' and name = ?`
+	if schema != "" {
+		query = `select count(*) from ` + quoteTableName(schema, `"`) + `.sqlite_master where type = 'table' and name = ?`
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, query, table).Scan(&count); err != nil {
+		return false, wrapf(err, "cannot check for table %s", tblname)
+	}
+	return count > 0, nil
 }
 
 func (w *sqlite) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error {
-	format := `insert into %s(id,applied_at,failed,locked) values(?,?,?,?);`
-	return commonInsertVersion(ctx, tx, tblname, ver, format)
+	format := `insert into %s(id,applied_at,failed,locked,duration_ms,description,checksum,applied_by) values(?,?,?,?,?,?,?,?);`
+	return commonInsertVersion(ctx, tx, w.quote(tblname), ver, format)
+}
+
+func (w *sqlite) InsertVersionDatabaseClock(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error {
+	insertFormat := `insert into %s(id,applied_at,failed,locked,duration_ms,description,checksum,applied_by) values(?,current_timestamp,?,?,?,?,?,?);`
+	selectFormat := `select applied_at from %s where id = ?;`
+	return commonInsertVersionDatabaseClock(ctx, tx, w.quote(tblname), ver, insertFormat, selectFormat)
 }
 
 func (w *sqlite) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
 	format := `delete from %s where id = ?;`
-	return commonDeleteVersion(ctx, tx, tblname, id, format)
+	return commonDeleteVersion(ctx, tx, w.quote(tblname), id, format)
 }
 
 func (w *sqlite) ListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
-	return commonListVersions(ctx, tx, tblname)
+	return commonListVersions(ctx, tx, w.quote(tblname))
+}
+
+func (w *sqlite) ListVersionsRange(ctx context.Context, tx *sql.Tx, tblname string, after VersionID, limit int) ([]*Version, error) {
+	return commonListVersionsRange(ctx, tx, w.quote(tblname), after, limit, "?")
+}
+
+func (w *sqlite) AddSQLColumns(ctx context.Context, db *sql.DB, tblname string) error {
+	return commonAddSQLColumns(ctx, db, w.quote(tblname), "text null")
+}
+
+func (w *sqlite) SetVersionSQL(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, up string, down string) error {
+	format := `update %s set up_sql = ?, down_sql = ? where id = ?`
+	return commonSetVersionSQL(ctx, tx, w.quote(tblname), id, up, down, format)
+}
+
+func (w *sqlite) ListVersionSQL(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
+	return commonListVersionSQL(ctx, tx, w.quote(tblname))
 }
 
 func (w *sqlite) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, failed bool) error {
 	format := `update %s set failed = ? where id = ?`
-	return commonSetBool(ctx, tx, tblname, id, failed, format)
+	return commonSetBool(ctx, tx, w.quote(tblname), id, failed, format)
 }
 
 func (w *sqlite) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, locked bool) error {
 	format := `update %s set locked = ? where id = ?`
-	return commonSetBool(ctx, tx, tblname, id, locked, format)
+	return commonSetBool(ctx, tx, w.quote(tblname), id, locked, format)
+}
+
+func (w *sqlite) SetVersionDuration(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, d time.Duration) error {
+	format := `update %s set duration_ms = ? where id = ?`
+	return commonSetDuration(ctx, tx, w.quote(tblname), id, d, format)
+}
+
+func (w *sqlite) SetVersionFailedStatement(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, n int) error {
+	format := `update %s set failed_statement = ? where id = ?`
+	return commonSetFailedStatement(ctx, tx, w.quote(tblname), id, n, format)
+}
+
+func (w *sqlite) AcquireLock(ctx context.Context, db *sql.DB, tblname string, timeout time.Duration) (*sql.Conn, error) {
+	// SQLite serializes writers, so no lock is necessary
+	return nil, nil
+}
+
+func (w *sqlite) ReleaseLock(ctx context.Context, conn *sql.Conn, tblname string) error {
+	return nil
+}
+
+// SupportsLocking reports false, because AcquireLock does not acquire
+// a lock. None is needed, because SQLite serializes writers.
+func (w *sqlite) SupportsLocking() bool {
+	return false
 }
 
 type mysql struct{}
@@ -159,42 +780,213 @@ func (w *mysql) PackageNames() []string {
 	return []string{"mysql"}
 }
 
+// quote returns the quoted migrations table name. A prefix
+// names the database containing the migrations table.
+func (w *mysql) quote(tblname string) string {
+	return quoteTableName(tblname, "`")
+}
+
 func (w *mysql) SupportsTransactionalDDL() bool {
 	return false
 }
 
+func (w *mysql) SupportsDropIfExists() bool {
+	return true
+}
+
+func (w *mysql) DropIndexOnTable() bool {
+	return true
+}
+
+func (w *mysql) DropTriggerByName() bool {
+	return true
+}
+
 func (w *mysql) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string) error {
 	format := `create table if not exists %s` +
-		`(id integer primary key` +
+		`(id bigint primary key` +
 		`,applied_at datetime not null` +
 		`,failed integer not null` +
 		`,locked integer not null` +
+		`,duration_ms bigint null` +
+		`,description text null` +
+		`,checksum varchar(64) null` +
+		`,failed_statement integer null` +
+		`,applied_by varchar(255) null` +
 		`);`
-	return commonCreateMigrationsTable(ctx, db, tblname, format)
+	if err := commonCreateMigrationsTable(ctx, db, w.quote(tblname), format); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "duration_ms", "bigint null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "description", "text null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "checksum", "varchar(64) null"); err != nil {
+		return err
+	}
+	if err := commonAddColumn(ctx, db, w.quote(tblname), "failed_statement", "integer null"); err != nil {
+		return err
+	}
+	return commonAddColumn(ctx, db, w.quote(tblname), "applied_by", "varchar(255) null")
+}
+
+func (w *mysql) MigrationsTableExists(ctx context.Context, db *sql.DB, tblname string) (bool, error) {
+	schema, table := splitTableName(tblname)
+	query := `select count(*) from information_schema.tables where table_schema = coalesce(nullif(?, ''), database()) and table_name = ?`
+	var count int
+	if err := db.QueryRowContext(ctx, query, schema, table).Scan(&count); err != nil {
+		return false, wrapf(err, "cannot check for table %s", tblname)
+	}
+	return count > 0, nil
 }
 
 func (w *mysql) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error {
-	format := `insert into %s(id,applied_at,failed,locked) values(?,?,?,?);`
-	return commonInsertVersion(ctx, tx, tblname, ver, format)
+	format := `insert into %s(id,applied_at,failed,locked,duration_ms,description,checksum,applied_by) values(?,?,?,?,?,?,?,?);`
+	return commonInsertVersion(ctx, tx, w.quote(tblname), ver, format)
+}
+
+// InsertVersionDatabaseClock uses utc_timestamp, because the worker
+// records times in UTC, whereas current_timestamp uses the session time zone.
+func (w *mysql) InsertVersionDatabaseClock(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error {
+	insertFormat := `insert into %s(id,applied_at,failed,locked,duration_ms,description,checksum,applied_by) values(?,utc_timestamp(),?,?,?,?,?,?);`
+	selectFormat := `select applied_at from %s where id = ?;`
+	return commonInsertVersionDatabaseClock(ctx, tx, w.quote(tblname), ver, insertFormat, selectFormat)
 }
 
 func (w *mysql) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
 	format := `delete from %s where id = ?;`
-	return commonDeleteVersion(ctx, tx, tblname, id, format)
+	return commonDeleteVersion(ctx, tx, w.quote(tblname), id, format)
+}
+
+func (w *mysql) AddSQLColumns(ctx context.Context, db *sql.DB, tblname string) error {
+	return commonAddSQLColumns(ctx, db, w.quote(tblname), "longtext null")
+}
+
+func (w *mysql) SetVersionSQL(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, up string, down string) error {
+	format := `update %s set up_sql = ?, down_sql = ? where id = ?`
+	return commonSetVersionSQL(ctx, tx, w.quote(tblname), id, up, down, format)
+}
+
+func (w *mysql) ListVersionSQL(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
+	return commonListVersionSQL(ctx, tx, w.quote(tblname))
 }
 
 func (w *mysql) ListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
-	return commonListVersions(ctx, tx, tblname)
+	return commonListVersions(ctx, tx, w.quote(tblname))
+}
+
+func (w *mysql) ListVersionsRange(ctx context.Context, tx *sql.Tx, tblname string, after VersionID, limit int) ([]*Version, error) {
+	return commonListVersionsRange(ctx, tx, w.quote(tblname), after, limit, "?")
 }
 
 func (w *mysql) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, failed bool) error {
 	format := `update %s set failed = ? where id = ?`
-	return commonSetBool(ctx, tx, tblname, id, failed, format)
+	return commonSetBool(ctx, tx, w.quote(tblname), id, failed, format)
 }
 
 func (w *mysql) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, locked bool) error {
 	format := `update %s set locked = ? where id = ?`
-	return commonSetBool(ctx, tx, tblname, id, locked, format)
+	return commonSetBool(ctx, tx, w.quote(tblname), id, locked, format)
+}
+
+func (w *mysql) SetVersionDuration(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, d time.Duration) error {
+	format := `update %s set duration_ms = ? where id = ?`
+	return commonSetDuration(ctx, tx, w.quote(tblname), id, d, format)
+}
+
+func (w *mysql) SetVersionFailedStatement(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, n int) error {
+	format := `update %s set failed_statement = ? where id = ?`
+	return commonSetFailedStatement(ctx, tx, w.quote(tblname), id, n, format)
+}
+
+func (w *mysql) SupportsLocking() bool {
+	return true
+}
+
+func (w *mysql) AcquireLock(ctx context.Context, db *sql.DB, tblname string, timeout time.Duration) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seconds := -1 // wait indefinitely
+	if timeout > 0 {
+		seconds = int((timeout + time.Second - 1) / time.Second)
+	}
+	var acquired sql.NullInt64
+	err = conn.QueryRowContext(ctx, `select get_lock(?, ?)`, lockName(tblname), seconds).Scan(&acquired)
+	if err == nil && acquired.Int64 != 1 {
+		err = errLockTimeout
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (w *mysql) ReleaseLock(ctx context.Context, conn *sql.Conn, tblname string) error {
+	_, err := conn.ExecContext(ctx, `select release_lock(?)`, lockName(tblname))
+	return releaseConn(conn, err)
+}
+
+// tableNameRE matches a valid migrations table name: an identifier
+// optionally prefixed by a schema name and a period.
+var tableNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*)?$`)
+
+// checkTableName returns an error if tblname is not a valid migrations
+// table name. Table names are included in SQL statements, so they are
+// restricted to plain identifiers to prevent SQL injection.
+func checkTableName(tblname string) error {
+	if !tableNameRE.MatchString(tblname) {
+		return fmt.Errorf("invalid migrations table name: %q", tblname)
+	}
+	return nil
+}
+
+var schemaNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// checkSchemaName returns an error if schema is not a valid search
+// path schema name.
+func checkSchemaName(schema string) error {
+	if !schemaNameRE.MatchString(schema) {
+		return fmt.Errorf("invalid search path schema name: %q", schema)
+	}
+	return nil
+}
+
+// splitTableName splits a migrations table name into its schema
+// and table parts. The schema is empty if the name has no prefix.
+func splitTableName(tblname string) (schema, table string) {
+	if n := strings.IndexByte(tblname, '.'); n >= 0 {
+		return tblname[:n], tblname[n+1:]
+	}
+	return "", tblname
+}
+
+// quoteTableName quotes each part of a "schema.table" or "table"
+// migrations table name. The name must have been checked by
+// checkTableName, so it contains no quote characters.
+func quoteTableName(tblname string, quote string) string {
+	parts := strings.Split(tblname, ".")
+	for i, part := range parts {
+		parts[i] = quote + part + quote
+	}
+	return strings.Join(parts, ".")
+}
+
+// lockKey returns the key of the advisory lock for the migrations table.
+func lockKey(tblname string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(tblname))
+	return int64(h.Sum64())
+}
+
+// lockName returns the name of the named lock for the migrations table.
+// MySQL lock names are limited to 64 characters.
+func lockName(tblname string) string {
+	return fmt.Sprintf("migration:%x", uint64(lockKey(tblname)))
 }
 
 func commonCreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string, format string) error {
@@ -208,10 +1000,28 @@ func commonCreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string
 
 func commonInsertVersion(ctx context.Context, tx *sql.Tx, tblname string, ver *Version, format string) error {
 	query := fmt.Sprintf(format, tblname)
-	_, err := tx.ExecContext(ctx, query, ver.ID, *ver.AppliedAt, ver.Failed, ver.Locked)
+	_, err := tx.ExecContext(ctx, query, ver.ID, *ver.AppliedAt, ver.Failed, ver.Locked, durationMillis(ver.Duration), ver.Description, ver.Checksum, ver.AppliedBy)
+	if err != nil {
+		return wrapf(err, "cannot insert migration version %d", ver.ID)
+	}
+	return nil
+}
+
+// commonInsertVersionDatabaseClock inserts a version using insertFormat,
+// which sets applied_at using the database clock, and then reads the
+// time recorded using selectFormat.
+func commonInsertVersionDatabaseClock(ctx context.Context, tx *sql.Tx, tblname string, ver *Version, insertFormat string, selectFormat string) error {
+	query := fmt.Sprintf(insertFormat, tblname)
+	_, err := tx.ExecContext(ctx, query, ver.ID, ver.Failed, ver.Locked, durationMillis(ver.Duration), ver.Description, ver.Checksum, ver.AppliedBy)
 	if err != nil {
 		return wrapf(err, "cannot insert migration version %d", ver.ID)
 	}
+	var appliedAt timeVal
+	query = fmt.Sprintf(selectFormat, tblname)
+	if err = tx.QueryRowContext(ctx, query, ver.ID).Scan(&appliedAt); err != nil {
+		return wrapf(err, "cannot query migration version %d", ver.ID)
+	}
+	ver.AppliedAt = &appliedAt.Time
 	return nil
 }
 
@@ -233,24 +1043,135 @@ func commonSetBool(ctx context.Context, tx *sql.Tx, tblname string, id VersionID
 	return nil
 }
 
-func commonListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
-	var versions []*Version
-	format := `select id,applied_at,failed,locked from %s order by id`
+func commonSetDuration(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, d time.Duration, format string) error {
+	query := fmt.Sprintf(format, tblname)
+	_, err := tx.ExecContext(ctx, query, durationMillis(d), id)
+	if err != nil {
+		return wrapf(err, "cannot update migration version %d", id)
+	}
+	return nil
+}
+
+func commonSetFailedStatement(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, n int, format string) error {
+	query := fmt.Sprintf(format, tblname)
+	_, err := tx.ExecContext(ctx, query, n, id)
+	if err != nil {
+		return wrapf(err, "cannot update migration version %d", id)
+	}
+	return nil
+}
+
+// commonAddColumn adds a column to the migrations table if it does not
+// already exist. This upgrades migrations tables created by earlier
+// versions of this package.
+func commonAddColumn(ctx context.Context, db *sql.DB, tblname string, column string, coltype string) error {
+	query := fmt.Sprintf("select %s from %s where 1 = 0", column, tblname)
+	rows, err := db.QueryContext(ctx, query)
+	if err == nil {
+		// column already exists
+		return rows.Close()
+	}
+	query = fmt.Sprintf("alter table %s add column %s %s", tblname, column, coltype)
+	if _, err = db.ExecContext(ctx, query); err != nil {
+		return wrapf(err, "cannot add column %s to table %s", column, tblname)
+	}
+	return nil
+}
+
+// commonAddSQLColumns adds the columns that store the up and down
+// migrations to the migrations table, if they do not already exist.
+func commonAddSQLColumns(ctx context.Context, db *sql.DB, tblname string, coltype string) error {
+	if err := commonAddColumn(ctx, db, tblname, "up_sql", coltype); err != nil {
+		return err
+	}
+	return commonAddColumn(ctx, db, tblname, "down_sql", coltype)
+}
+
+func commonSetVersionSQL(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, up string, down string, format string) error {
 	query := fmt.Sprintf(format, tblname)
+	_, err := tx.ExecContext(ctx, query, up, down, id)
+	if err != nil {
+		return wrapf(err, "cannot update migration version %d", id)
+	}
+	return nil
+}
+
+func commonListVersionSQL(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
+	query := fmt.Sprintf(`select id,up_sql,down_sql from %s order by id`, tblname)
 	rows, err := tx.QueryContext(ctx, query)
 	if err != nil {
 		return nil, wrapf(err, "cannot query versions")
 	}
+	defer rows.Close()
+	var versions []*Version
+	for rows.Next() {
+		var (
+			ver  Version
+			up   sql.NullString
+			down sql.NullString
+		)
+		if err = rows.Scan(&ver.ID, &up, &down); err != nil {
+			return nil, wrapf(err, "cannot scan version")
+		}
+		ver.Up = up.String
+		ver.Down = down.String
+		versions = append(versions, &ver)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, wrapf(err, "cannot query versions")
+	}
+	return versions, nil
+}
+
+func durationMillis(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// versionColumns are the columns selected by commonQueryVersions.
+const versionColumns = `id,applied_at,failed,locked,duration_ms,description,checksum,failed_statement,applied_by`
+
+func commonListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
+	query := fmt.Sprintf(`select %s from %s order by id`, versionColumns, tblname)
+	return commonQueryVersions(ctx, tx, query)
+}
+
+// commonListVersionsRange lists versions greater than after, in ascending
+// order. The placeholder for the version parameter is database specific.
+func commonListVersionsRange(ctx context.Context, tx *sql.Tx, tblname string, after VersionID, limit int, placeholder string) ([]*Version, error) {
+	query := fmt.Sprintf(`select %s from %s where id > %s order by id`, versionColumns, tblname, placeholder)
+	if limit > 0 {
+		query += fmt.Sprintf(" limit %d", limit)
+	}
+	return commonQueryVersions(ctx, tx, query, after)
+}
+
+func commonQueryVersions(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]*Version, error) {
+	var versions []*Version
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapf(err, "cannot query versions")
+	}
+	defer rows.Close()
 	for rows.Next() {
 		var (
-			ver       Version
-			appliedAt timeVal
+			ver         Version
+			appliedAt   timeVal
+			durationMS  sql.NullInt64
+			description sql.NullString
+			checksum    sql.NullString
+			failedStmt  sql.NullInt64
+			appliedBy   sql.NullString
 		)
 
-		if err = rows.Scan(&ver.ID, &appliedAt, &ver.Failed, &ver.Locked); err != nil {
+		if err = rows.Scan(&ver.ID, &appliedAt, &ver.Failed, &ver.Locked, &durationMS, &description, &checksum, &failedStmt, &appliedBy); err != nil {
 			return nil, wrapf(err, "cannot scan version")
 		}
 		ver.AppliedAt = &appliedAt.Time
+		ver.Duration = time.Duration(durationMS.Int64) * time.Millisecond
+		ver.Description = description.String
+		ver.Checksum = checksum.String
+		ver.FailedStatement = int(failedStmt.Int64)
+		ver.AppliedBy = appliedBy.String
 		versions = append(versions, &ver)
 	}
 	if err = rows.Err(); err != nil {
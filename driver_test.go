@@ -0,0 +1,240 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// wrappedSQLite is a database/sql driver with a distinct type,
+// which is not recognised by any built-in migration driver.
+type wrappedSQLite struct {
+	sqlite3.SQLiteDriver
+}
+
+// countingDriver is a migration driver that counts the number
+// of times the migrations table is created.
+type countingDriver struct {
+	sqlite
+	createCount int
+}
+
+func (d *countingDriver) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string) error {
+	d.createCount++
+	return d.sqlite.CreateMigrationsTable(ctx, db, tblname)
+}
+
+var (
+	registerOnce   sync.Once
+	registeredDrv  = &countingDriver{}
+	registeredName = "migration_test_sqlite3"
+)
+
+func TestRegisterDriver(t *testing.T) {
+	registerOnce.Do(func() {
+		sql.Register(registeredName, &wrappedSQLite{})
+		RegisterDriver(registeredName, registeredDrv)
+	})
+
+	ctx := context.Background()
+	db, err := sql.Open(registeredName, ":memory:")
+	wantNoError(t, err)
+	defer db.Close()
+
+	worker, err := NewWorker(db, newTestSchema())
+	wantNoError(t, err)
+	if worker.drv != registeredDrv {
+		t.Fatalf("got=%T, want=%T", worker.drv, registeredDrv)
+	}
+
+	err = worker.Up(ctx)
+	wantNoError(t, err)
+	if got, want := registeredDrv.createCount > 0, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// databases opened with other drivers are unaffected
+	drv, err := findDriver(openMemoryDB(t))
+	wantNoError(t, err)
+	if _, ok := drv.(*sqlite); !ok {
+		t.Errorf("got=%T, want=*sqlite", drv)
+	}
+}
+
+// txOptionsSQLite is a database/sql driver that records the isolation
+// level of each transaction.
+type txOptionsSQLite struct {
+	sqlite3.SQLiteDriver
+}
+
+// txOptionsConn is a connection opened by txOptionsSQLite.
+type txOptionsConn struct {
+	*sqlite3.SQLiteConn
+}
+
+var (
+	txOptionsOnce sync.Once
+	txOptionsMu   sync.Mutex
+	txIsolations  []sql.IsolationLevel
+)
+
+func (d *txOptionsSQLite) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &txOptionsConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+func (c *txOptionsConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	txOptionsMu.Lock()
+	txIsolations = append(txIsolations, sql.IsolationLevel(opts.Isolation))
+	txOptionsMu.Unlock()
+	return c.SQLiteConn.BeginTx(ctx, opts)
+}
+
+func TestWorkerTxOptions(t *testing.T) {
+	const name = "migration_test_txoptions"
+	txOptionsOnce.Do(func() {
+		sql.Register(name, &txOptionsSQLite{})
+		RegisterDriver(name, &sqlite{})
+	})
+
+	ctx := context.Background()
+	db, err := sql.Open(name, ":memory:")
+	wantNoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	worker, err := NewWorker(db, newTestSchema())
+	wantNoError(t, err)
+	worker.TxOptions = &sql.TxOptions{Isolation: sql.LevelSerializable}
+	txIsolations = nil
+	wantNoError(t, worker.Up(ctx))
+
+	// one transaction for each migration, the others use the default
+	var serializable int
+	for _, level := range txIsolations {
+		if level == sql.LevelSerializable {
+			serializable++
+		}
+	}
+	if got, want := serializable, 2; got != want {
+		t.Errorf("got=%d, want=%d", got, want)
+	}
+	if got := len(txIsolations); got <= serializable {
+		t.Errorf("got=%d transactions, want more than %d", got, serializable)
+	}
+}
+
+// detectingSQLite is a migration driver that replaces itself
+// with another driver when it detects the database.
+type detectingSQLite struct {
+	sqlite
+	detectCount int
+	replacement Driver
+}
+
+func (d *detectingSQLite) detect(ctx context.Context, db *sql.DB) (Driver, error) {
+	d.detectCount++
+	return d.replacement, nil
+}
+
+func TestListVersionsRange(t *testing.T) {
+	ctx := context.Background()
+	db := openMemoryDB(t)
+
+	var schema Schema
+	for _, id := range []VersionID{1, 2, 3, 4, 5} {
+		schema.Define(id).Up(`-- nothing`).Down(`-- nothing`)
+	}
+	worker, err := NewWorker(db, &schema)
+	wantNoError(t, err)
+	wantNoError(t, worker.Up(ctx))
+
+	drv := &sqlite{}
+	tx, err := db.BeginTx(ctx, nil)
+	wantNoError(t, err)
+	defer tx.Rollback()
+	versions, err := drv.ListVersionsRange(ctx, tx, worker.tableName(), 2, 2)
+	wantNoError(t, err)
+	var ids []VersionID
+	for _, ver := range versions {
+		ids = append(ids, ver.ID)
+	}
+	if got, want := ids, []VersionID{3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestDetectDriver(t *testing.T) {
+	ctx := context.Background()
+	db := openMemoryDB(t)
+
+	worker, err := NewWorker(db, newTestSchema())
+	wantNoError(t, err)
+	replacement := &countingDriver{}
+	drv := &detectingSQLite{replacement: replacement}
+	worker.drv = drv
+
+	wantNoError(t, worker.Up(ctx))
+	wantNoError(t, worker.Down(ctx))
+	if got, want := drv.detectCount, 1; got != want {
+		t.Errorf("got=%d, want=%d", got, want)
+	}
+	if worker.drv != replacement {
+		t.Errorf("got=%T, want=%T", worker.drv, replacement)
+	}
+	if got, want := replacement.createCount > 0, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestCockroachDB(t *testing.T) {
+	dsn := os.Getenv("CRDB_TEST_DSN")
+	if dsn == "" {
+		t.Skip("no test database")
+	}
+	ctx := context.Background()
+	db, err := sql.Open("postgres", dsn)
+	wantNoError(t, err)
+	defer db.Close()
+
+	worker, err := NewWorker(db, newTestSchema())
+	wantNoError(t, err)
+	wantNoError(t, worker.Up(ctx))
+	defer func() {
+		wantNoError(t, worker.Goto(ctx, 0))
+	}()
+	if _, ok := worker.drv.(*cockroach); !ok {
+		t.Errorf("got=%T, want=*cockroach", worker.drv)
+	}
+
+	id, err := worker.CurrentVersion(ctx)
+	wantNoError(t, err)
+	if got, want := id, VersionID(20); got != want {
+		t.Errorf("got=%d, want=%d", got, want)
+	}
+
+	// columns added by later versions are added to an existing table
+	_, err = db.ExecContext(ctx, `create table old_migrations(id int8 primary key, applied_at timestamptz not null,`+
+		` failed bool not null default false, locked bool not null default false)`)
+	wantNoError(t, err)
+	defer db.ExecContext(ctx, `drop table old_migrations`)
+	wantNoError(t, worker.drv.CreateMigrationsTable(ctx, db, "old_migrations"))
+	_, err = db.ExecContext(ctx, `select duration_ms, description, checksum, failed_statement, applied_by from old_migrations`)
+	wantNoError(t, err)
+
+	// CockroachDB does not support advisory locks
+	conn, err := worker.drv.AcquireLock(ctx, db, DefaultMigrationsTable, 0)
+	wantNoError(t, err)
+	if conn != nil {
+		t.Error("want nil connection")
+	}
+}
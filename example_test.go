@@ -29,6 +29,9 @@ func Example() {
 	db, err := sql.Open("sqlite3", ":memory:")
 	checkError(err)
 
+	// Each connection to an in-memory database is a separate database.
+	db.SetMaxOpenConns(1)
+
 	// A worker does the work, and can optionally log its progress.
 	worker, err := migration.NewWorker(db, &Schema)
 	checkError(err)
@@ -0,0 +1,259 @@
+package migration
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fileNameRE matches migration file names such as "0001_create_city.up.sql".
+var fileNameRE = regexp.MustCompile(`^(\d+)(?:_([^.]*))?\.(up|down)\.sql$`)
+
+// singleFileNameRE matches single-file migration names such as "0001_create_city.sql".
+var singleFileNameRE = regexp.MustCompile(`^(\d+)(?:_([^.]*))?\.sql$`)
+
+// annotationRE matches annotation comments such as "-- +migration Up".
+var annotationRE = regexp.MustCompile(`^--\s*\+migration\b(.*)$`)
+
+// NewSchemaFromFS returns a schema containing the database schema versions
+// defined by the SQL files in directory dir of fsys. The files are named using
+// the same convention as Schema.LoadFS.
+//
+// If fsys is an embed.FS, the migrations are embedded in the executable
+// without the need to deploy any separate files:
+//
+//	//go:embed migrations
+//	var migrations embed.FS
+//
+//	schema, err := migration.NewSchemaFromFS(migrations, "migrations")
+//
+// If there are any errors in the migration schema definition, they are
+// returned as Errors.
+func NewSchemaFromFS(fsys fs.FS, dir string) (*Schema, error) {
+	var s Schema
+	if err := s.LoadFS(fsys, path.Join(dir, "*.sql")); err != nil {
+		return nil, err
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// LoadFS defines database schema versions from the SQL files in fsys whose
+// names match the glob pattern. (See fs.Glob for the pattern syntax).
+//
+// Each file name starts with the database schema version, followed by an
+// optional description, and ends with ".up.sql" or ".down.sql". Underscores in
+// the description are replaced with spaces. For example:
+//
+//	0001_create_city.up.sql
+//	0001_create_city.down.sql
+//
+// If the down file is missing, the down migration is derived from the up
+// migration if possible. (See Definition.Down).
+//
+// Files with invalid names, missing up or down files, and versions defined
+// more than once are reported by the Err method in the same way as other
+// errors in the migration schema definition. LoadFS only reports an error
+// if the files cannot be read.
+func (s *Schema) LoadFS(fsys fs.FS, glob string) error {
+	names, err := fs.Glob(fsys, glob)
+	if err != nil {
+		return err
+	}
+
+	type sqlFiles struct {
+		description string
+		ups         []string
+		downs       []string
+	}
+	files := make(map[VersionID]*sqlFiles)
+
+	for _, name := range names {
+		match := fileNameRE.FindStringSubmatch(path.Base(name))
+		if match == nil {
+			s.errs = append(s.errs, &Error{
+				Description: fmt.Sprintf("invalid migration file name: %s", name),
+			})
+			continue
+		}
+		n, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || n <= 0 {
+			s.errs = append(s.errs, &Error{
+				Description: fmt.Sprintf("invalid version in migration file name: %s", name),
+			})
+			continue
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		id := VersionID(n)
+		f := files[id]
+		if f == nil {
+			f = &sqlFiles{}
+			files[id] = f
+		}
+		if f.description == "" {
+			f.description = strings.Replace(match[2], "_", " ", -1)
+		}
+		if match[3] == "up" {
+			f.ups = append(f.ups, string(data))
+		} else {
+			f.downs = append(f.downs, string(data))
+		}
+	}
+
+	ids := make([]VersionID, 0, len(files))
+	for id := range files {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	for _, id := range ids {
+		f := files[id]
+		d := s.Define(id).Describe(f.description)
+		for _, sql := range f.ups {
+			d.Up(sql)
+		}
+		for _, sql := range f.downs {
+			d.Down(sql)
+		}
+	}
+
+	return nil
+}
+
+// ParseFile defines a database schema version from a single SQL file that
+// contains both the up and down migrations, separated by annotation comments.
+// This is the format used by goose and similar tools:
+//
+//	-- +migration Up
+//	create table city(id int primary key, name text);
+//
+//	-- +migration Down
+//	drop table city;
+//
+// The version is specified by a "-- +migration Version N" annotation, or
+// if there is no such annotation, by the file name, which starts with the
+// version followed by an optional description, for example
+// "0001_create_city.sql". The name is also used in error messages. If the
+// down section is missing, the down migration is derived from the up
+// migration if possible. (See Definition.Down).
+//
+// Invalid annotations, SQL before the first up or down annotation, and a
+// missing version are reported by the Err method in the same way as other
+// errors in the migration schema definition. ParseFile only reports an error
+// if r cannot be read.
+func (s *Schema) ParseFile(name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.DefineFromString(name, string(data))
+	return nil
+}
+
+// DefineFromString defines a database schema version from text, which is in
+// the same format as a single SQL file parsed by ParseFile. The name is used
+// in the same way as the file name passed to ParseFile.
+func (s *Schema) DefineFromString(name string, text string) {
+	var (
+		id          VersionID
+		description string
+		versionLine int // line of the version annotation, if any
+		section     string
+		lines       []string
+		ups         []string
+		downs       []string
+	)
+
+	addError := func(lineno int, format string, args ...interface{}) {
+		s.errs = append(s.errs, &Error{
+			Version:     id,
+			Description: fmt.Sprintf("%s:%d: ", name, lineno) + fmt.Sprintf(format, args...),
+		})
+	}
+
+	flush := func() {
+		sql := strings.TrimSpace(strings.Join(lines, "\n"))
+		switch section {
+		case "up":
+			ups = append(ups, sql)
+		case "down":
+			downs = append(downs, sql)
+		}
+		lines = nil
+	}
+
+	for i, line := range strings.Split(text, "\n") {
+		lineno := i + 1
+		trimmed := strings.TrimSpace(line)
+		match := annotationRE.FindStringSubmatch(trimmed)
+		if match == nil {
+			if section == "" && trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+				addError(lineno, "sql before up or down annotation")
+				return
+			}
+			lines = append(lines, line)
+			continue
+		}
+		fields := strings.Fields(match[1])
+		switch {
+		case len(fields) == 1 && strings.EqualFold(fields[0], "up"):
+			flush()
+			section = "up"
+		case len(fields) == 1 && strings.EqualFold(fields[0], "down"):
+			flush()
+			section = "down"
+		case len(fields) == 2 && strings.EqualFold(fields[0], "version"):
+			n, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || n <= 0 {
+				addError(lineno, "invalid version: %s", fields[1])
+				return
+			}
+			if versionLine > 0 {
+				addError(lineno, "version already specified on line %d", versionLine)
+				return
+			}
+			id = VersionID(n)
+			versionLine = lineno
+		default:
+			addError(lineno, "invalid annotation: %s", trimmed)
+			return
+		}
+	}
+	flush()
+
+	if match := singleFileNameRE.FindStringSubmatch(path.Base(name)); match != nil {
+		if id == 0 {
+			n, err := strconv.ParseInt(match[1], 10, 64)
+			if err == nil && n > 0 {
+				id = VersionID(n)
+			}
+		}
+		description = strings.Replace(match[2], "_", " ", -1)
+	}
+	if id == 0 {
+		s.errs = append(s.errs, &Error{
+			Description: fmt.Sprintf("no version annotation or version in file name: %s", name),
+		})
+		return
+	}
+
+	d := s.Define(id).Describe(description)
+	for _, sql := range ups {
+		d.Up(sql)
+	}
+	for _, sql := range downs {
+		d.Down(sql)
+	}
+}
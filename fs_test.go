@@ -0,0 +1,254 @@
+package migration
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSchemaLoadFS(t *testing.T) {
+	tests := []struct {
+		files fstest.MapFS
+		glob  string
+		errs  []string
+		ids   []VersionID
+	}{
+		{
+			files: fstest.MapFS{
+				"migrations/0001_create_city.up.sql":      {Data: []byte("create table city(id int);")},
+				"migrations/0001_create_city.down.sql":    {Data: []byte("drop table city;")},
+				"migrations/0002_create_country.up.sql":   {Data: []byte("create table country(id int);")},
+				"migrations/0002_create_country.down.sql": {Data: []byte("drop table country;")},
+				"migrations/README.md":                    {Data: []byte("not a migration")},
+			},
+			glob: "migrations/*.sql",
+			ids:  []VersionID{1, 2},
+		},
+		{
+			files: fstest.MapFS{
+				"3.up.sql":   {Data: []byte("create table t3(id int);")},
+				"3.down.sql": {Data: []byte("drop table t3;")},
+			},
+			glob: "*.sql",
+			ids:  []VersionID{3},
+		},
+		{
+			files: fstest.MapFS{
+				"0001_create_city.up.sql": {Data: []byte("create table city(id int);")},
+			},
+			glob: "*.sql",
+			ids:  []VersionID{1},
+		},
+		{
+			files: fstest.MapFS{
+				"0001_insert_city.up.sql": {Data: []byte("insert into city(id) values(1);")},
+			},
+			glob: "*.sql",
+			errs: []string{
+				"1: down migration not defined: cannot reverse statement: insert into city(id) values(1)",
+			},
+		},
+		{
+			files: fstest.MapFS{
+				"0001_create_city.up.sql":   {Data: []byte("create table city(id int);")},
+				"0001_create_city.down.sql": {Data: []byte("drop table city;")},
+				"1_duplicate.up.sql":        {Data: []byte("create table city(id int);")},
+			},
+			glob: "*.sql",
+			errs: []string{
+				"1: up migration defined 2 times",
+			},
+		},
+		{
+			files: fstest.MapFS{
+				"create_city.up.sql": {Data: []byte("create table city(id int);")},
+			},
+			glob: "*.sql",
+			errs: []string{
+				"0: invalid migration file name: create_city.up.sql",
+			},
+		},
+	}
+
+	for tn, tt := range tests {
+		var s Schema
+		if err := s.LoadFS(tt.files, tt.glob); err != nil {
+			t.Errorf("%d: %v", tn, err)
+			continue
+		}
+		errs, _ := s.Err().(Errors)
+		var errTexts []string
+		for _, e := range errs {
+			errTexts = append(errTexts, e.Error())
+		}
+		if got, want := strings.Join(errTexts, "\n"), strings.Join(tt.errs, "\n"); got != want {
+			t.Errorf("%d:\ngot:\n%s\n\nwant:\n%s\n\n", tn, got, want)
+			continue
+		}
+		if len(tt.errs) > 0 {
+			continue
+		}
+		if got, want := len(s.plans), len(tt.ids); got != want {
+			t.Errorf("%d: got=%v, want=%v", tn, got, want)
+			continue
+		}
+		for i, id := range tt.ids {
+			if got, want := s.plans[i].id, id; got != want {
+				t.Errorf("%d: got=%v, want=%v", tn, got, want)
+			}
+		}
+	}
+}
+
+func TestNewSchemaFromFS(t *testing.T) {
+	files := fstest.MapFS{
+		"migrations/0001_create_city.up.sql":   {Data: []byte("create table city(id int);")},
+		"migrations/0001_create_city.down.sql": {Data: []byte("drop table city;")},
+		"migrations/0002.up.sql":               {Data: []byte("create table country(id int);")},
+		"migrations/0002.down.sql":             {Data: []byte("drop table country;")},
+	}
+
+	s, err := NewSchemaFromFS(files, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.definitions[1].description, "create city"; got != want {
+		t.Errorf("got=%q, want=%q", got, want)
+	}
+	if got, want := s.definitions[2].description, ""; got != want {
+		t.Errorf("got=%q, want=%q", got, want)
+	}
+
+	files["migrations/0002.up.sql"] = &fstest.MapFile{Data: []byte("insert into country(id) values(1);")}
+	delete(files, "migrations/0002.down.sql")
+	_, err = NewSchemaFromFS(files, "migrations")
+	if _, ok := err.(Errors); !ok {
+		t.Fatalf("got=%v, want=Errors", err)
+	}
+}
+
+func TestSchemaDefineFromString(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		errs        []string
+		id          VersionID
+		description string
+		up          string
+		down        string
+	}{
+		{
+			name: "0003_create_city.sql",
+			text: "-- a comment before the annotations\n" +
+				"-- +migration Up\n" +
+				"create table city(id int);\n" +
+				"\n" +
+				"-- +migration Down\n" +
+				"drop table city;\n",
+			id:          3,
+			description: "create city",
+			up:          "create table city(id int);",
+			down:        "drop table city;",
+		},
+		{
+			name: "city.sql",
+			text: "-- +migration Version 20170506082420\n" +
+				"-- +migration Up\n" +
+				"create table city(id int);\n",
+			id:   20170506082420,
+			up:   "create table city(id int);",
+			down: "drop table city;",
+		},
+		{
+			name: "city.sql",
+			text: "-- +migration Up\n" +
+				"create table city(id int);\n",
+			errs: []string{
+				"0: no version annotation or version in file name: city.sql",
+			},
+		},
+		{
+			name: "0001.sql",
+			text: "create table city(id int);\n" +
+				"-- +migration Up\n",
+			errs: []string{
+				"0: 0001.sql:1: sql before up or down annotation",
+			},
+		},
+		{
+			name: "0001.sql",
+			text: "-- +migration Up\n" +
+				"create table city(id int);\n" +
+				"-- +migration Sideways\n",
+			errs: []string{
+				"0: 0001.sql:3: invalid annotation: -- +migration Sideways",
+			},
+		},
+		{
+			name: "city.sql",
+			text: "-- +migration Version 2\n" +
+				"-- +migration Version 3\n",
+			errs: []string{
+				"2: city.sql:2: version already specified on line 1",
+			},
+		},
+		{
+			name: "0001.sql",
+			text: "-- +migration Up\n" +
+				"create table city(id int);\n" +
+				"-- +migration Up\n" +
+				"create table country(id int);\n",
+			errs: []string{
+				"1: up migration defined 2 times",
+			},
+		},
+	}
+
+	for tn, tt := range tests {
+		var s Schema
+		s.DefineFromString(tt.name, tt.text)
+		errs, _ := s.Err().(Errors)
+		var errTexts []string
+		for _, e := range errs {
+			errTexts = append(errTexts, e.Error())
+		}
+		if got, want := strings.Join(errTexts, "\n"), strings.Join(tt.errs, "\n"); got != want {
+			t.Errorf("%d:\ngot:\n%s\n\nwant:\n%s\n\n", tn, got, want)
+			continue
+		}
+		if len(tt.errs) > 0 {
+			continue
+		}
+		plan := s.Plan()
+		if got, want := len(plan), 1; got != want {
+			t.Errorf("%d: got=%v, want=%v", tn, got, want)
+			continue
+		}
+		if got, want := plan[0].ID, tt.id; got != want {
+			t.Errorf("%d: got=%v, want=%v", tn, got, want)
+		}
+		if got, want := plan[0].Description, tt.description; got != want {
+			t.Errorf("%d: got=%q, want=%q", tn, got, want)
+		}
+		if got, want := plan[0].UpSQL, tt.up; got != want {
+			t.Errorf("%d: got=%q, want=%q", tn, got, want)
+		}
+		if got, want := strings.TrimSpace(plan[0].DownSQL), tt.down; got != want {
+			t.Errorf("%d: got=%q, want=%q", tn, got, want)
+		}
+	}
+}
+
+func TestSchemaParseFile(t *testing.T) {
+	var s Schema
+	err := s.ParseFile("0001_create_city.sql", strings.NewReader("-- +migration Up\ncreate table city(id int);\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.definitions[1].description, "create city"; got != want {
+		t.Errorf("got=%q, want=%q", got, want)
+	}
+}
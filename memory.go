@@ -0,0 +1,360 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryDriver is a migration driver that keeps the migrations table in
+// memory. It is intended for unit testing the migrations performed by a
+// worker, including ordering, locked versions and failure recovery,
+// without a real database.
+//
+// Use the database returned by DB with the driver, and create the worker
+// using NewWorkerWithDriver:
+//
+//	drv := &migration.MemoryDriver{}
+//	worker, err := migration.NewWorkerWithDriver(drv.DB(), drv, schema)
+//
+// The database does not execute SQL: each statement is passed to the Exec
+// function, if specified, which can simulate a failed migration by
+// returning an error. Changes to the migrations table are discarded if
+// the transaction that made them is rolled back.
+type MemoryDriver struct {
+	// NoTransactionalDDL, if set, causes the driver to report that the
+	// database does not support transactional DDL, so that SQL migrations
+	// are performed outside of a transaction, as they are for MySQL.
+	NoTransactionalDDL bool
+
+	// Exec, if specified, is called for each SQL statement executed by a
+	// migration. If it returns an error, the statement fails with the error.
+	// Statements are passed one at a time.
+	Exec func(query string) error
+
+	once   sync.Once
+	db     *sql.DB
+	mu     sync.Mutex   // protects tables
+	tables memoryTables // committed rows
+}
+
+// memoryQuery is the query text used by the driver to access the
+// migrations table. The operation is passed as the only argument.
+const memoryQuery = "-- migration: memory driver operation"
+
+// memoryTables maps the name of each migrations table to its rows.
+type memoryTables map[string]map[VersionID]*Version
+
+// memoryFunc is an operation that changes the migrations tables.
+type memoryFunc func(tables memoryTables) error
+
+// memoryRead is an operation that reads the migrations tables.
+type memoryRead func(tables memoryTables) error
+
+// clone returns a copy of the tables.
+func (t memoryTables) clone() memoryTables {
+	c := make(memoryTables, len(t))
+	for name, rows := range t {
+		c[name] = make(map[VersionID]*Version, len(rows))
+		for id, ver := range rows {
+			row := *ver
+			c[name][id] = &row
+		}
+	}
+	return c
+}
+
+// rows returns the rows of the table, or an error if it does not exist.
+func (t memoryTables) rows(tblname string) (map[VersionID]*Version, error) {
+	rows, ok := t[tblname]
+	if !ok {
+		return nil, fmt.Errorf("no such table: %s", tblname)
+	}
+	return rows, nil
+}
+
+// DB returns the in-memory database used with the driver. It returns
+// the same database each time it is called.
+func (d *MemoryDriver) DB() *sql.DB {
+	d.once.Do(func() {
+		d.tables = make(memoryTables)
+		d.db = sql.OpenDB(&memoryConnector{d: d})
+	})
+	return d.db
+}
+
+// exec performs fn on the migrations tables, as part of a transaction
+// if e is a transaction. The fn parameter is a memoryFunc or memoryRead.
+func (d *MemoryDriver) exec(ctx context.Context, e execer, fn interface{}) error {
+	_, err := e.ExecContext(ctx, memoryQuery, fn)
+	return err
+}
+
+// update performs fn on the row for version id, if it exists.
+func (d *MemoryDriver) update(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, fn func(ver *Version)) error {
+	return d.exec(ctx, tx, memoryFunc(func(tables memoryTables) error {
+		rows, err := tables.rows(tblname)
+		if err != nil {
+			return err
+		}
+		if ver := rows[id]; ver != nil {
+			fn(ver)
+		}
+		return nil
+	}))
+}
+
+// SupportsTransactionalDDL implements the Driver interface.
+func (d *MemoryDriver) SupportsTransactionalDDL() bool {
+	return !d.NoTransactionalDDL
+}
+
+// SupportsMultipleStatements implements the MultiStatementDriver interface.
+// It reports false, so that statements are passed to Exec one at a time.
+func (d *MemoryDriver) SupportsMultipleStatements() bool {
+	return false
+}
+
+// PackageNames implements the Driver interface.
+func (d *MemoryDriver) PackageNames() []string {
+	return nil
+}
+
+// CreateMigrationsTable implements the Driver interface.
+func (d *MemoryDriver) CreateMigrationsTable(ctx context.Context, db *sql.DB, tblname string) error {
+	return d.exec(ctx, db, memoryFunc(func(tables memoryTables) error {
+		if _, ok := tables[tblname]; !ok {
+			tables[tblname] = make(map[VersionID]*Version)
+		}
+		return nil
+	}))
+}
+
+// MigrationsTableExists implements the Driver interface.
+func (d *MemoryDriver) MigrationsTableExists(ctx context.Context, db *sql.DB, tblname string) (bool, error) {
+	var exists bool
+	err := d.exec(ctx, db, memoryRead(func(tables memoryTables) error {
+		_, exists = tables[tblname]
+		return nil
+	}))
+	return exists, err
+}
+
+// InsertVersion implements the Driver interface.
+func (d *MemoryDriver) InsertVersion(ctx context.Context, tx *sql.Tx, tblname string, ver *Version) error {
+	inserted := *ver
+	return d.exec(ctx, tx, memoryFunc(func(tables memoryTables) error {
+		rows, err := tables.rows(tblname)
+		if err != nil {
+			return err
+		}
+		if _, ok := rows[inserted.ID]; ok {
+			return fmt.Errorf("duplicate version: %d", inserted.ID)
+		}
+		row := inserted
+		rows[row.ID] = &row
+		return nil
+	}))
+}
+
+// DeleteVersion implements the Driver interface.
+func (d *MemoryDriver) DeleteVersion(ctx context.Context, tx *sql.Tx, tblname string, id VersionID) error {
+	return d.exec(ctx, tx, memoryFunc(func(tables memoryTables) error {
+		rows, err := tables.rows(tblname)
+		if err != nil {
+			return err
+		}
+		delete(rows, id)
+		return nil
+	}))
+}
+
+// ListVersions implements the Driver interface.
+func (d *MemoryDriver) ListVersions(ctx context.Context, tx *sql.Tx, tblname string) ([]*Version, error) {
+	var versions []*Version
+	err := d.exec(ctx, tx, memoryRead(func(tables memoryTables) error {
+		rows, err := tables.rows(tblname)
+		if err != nil {
+			return err
+		}
+		for _, ver := range rows {
+			row := *ver
+			versions = append(versions, &row)
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID < versions[j].ID
+	})
+	return versions, nil
+}
+
+// SetVersionFailed implements the Driver interface.
+func (d *MemoryDriver) SetVersionFailed(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, failed bool) error {
+	return d.update(ctx, tx, tblname, id, func(ver *Version) {
+		ver.Failed = failed
+	})
+}
+
+// SetVersionLocked implements the Driver interface.
+func (d *MemoryDriver) SetVersionLocked(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, locked bool) error {
+	return d.update(ctx, tx, tblname, id, func(ver *Version) {
+		ver.Locked = locked
+	})
+}
+
+// SetVersionDuration implements the Driver interface.
+func (d *MemoryDriver) SetVersionDuration(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, duration time.Duration) error {
+	return d.update(ctx, tx, tblname, id, func(ver *Version) {
+		ver.Duration = duration
+	})
+}
+
+// SetVersionFailedStatement implements the StatementProgressDriver interface.
+func (d *MemoryDriver) SetVersionFailedStatement(ctx context.Context, tx *sql.Tx, tblname string, id VersionID, n int) error {
+	return d.update(ctx, tx, tblname, id, func(ver *Version) {
+		ver.FailedStatement = n
+	})
+}
+
+// AcquireLock implements the Driver interface. The driver does not
+// support locking, so it returns a nil connection.
+func (d *MemoryDriver) AcquireLock(ctx context.Context, db *sql.DB, tblname string, timeout time.Duration) (*sql.Conn, error) {
+	return nil, nil
+}
+
+// ReleaseLock implements the Driver interface.
+func (d *MemoryDriver) ReleaseLock(ctx context.Context, conn *sql.Conn, tblname string) error {
+	return nil
+}
+
+// SupportsLocking implements the LockingDriver interface. It reports
+// false, because the driver does not lock.
+func (d *MemoryDriver) SupportsLocking() bool {
+	return false
+}
+
+// memoryConnector is the database/sql connector for the database
+// returned by MemoryDriver.DB.
+type memoryConnector struct {
+	d *MemoryDriver
+}
+
+func (c *memoryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &memoryConn{d: c.d}, nil
+}
+
+func (c *memoryConnector) Driver() driver.Driver {
+	return memorySQLDriver{d: c.d}
+}
+
+// memorySQLDriver is the database/sql driver for the database returned
+// by MemoryDriver.DB.
+type memorySQLDriver struct {
+	d *MemoryDriver
+}
+
+func (drv memorySQLDriver) Open(name string) (driver.Conn, error) {
+	return &memoryConn{d: drv.d}, nil
+}
+
+// memoryConn is a connection to the database returned by MemoryDriver.DB.
+type memoryConn struct {
+	d  *MemoryDriver
+	tx *memoryTx // current transaction, if any
+}
+
+// memoryTx is a transaction in the database returned by MemoryDriver.DB.
+// Operations are performed on a copy of the tables, so that they are
+// visible within the transaction, and performed again on the committed
+// tables when the transaction is committed.
+type memoryTx struct {
+	c      *memoryConn
+	tables memoryTables
+	ops    []memoryFunc
+}
+
+func (c *memoryConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("memory database does not support queries")
+}
+
+func (c *memoryConn) Close() error {
+	return nil
+}
+
+func (c *memoryConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *memoryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.d.mu.Lock()
+	tables := c.d.tables.clone()
+	c.d.mu.Unlock()
+	c.tx = &memoryTx{c: c, tables: tables}
+	return c.tx, nil
+}
+
+// CheckNamedValue accepts all arguments, so that operations on the
+// migrations tables can be passed to ExecContext.
+func (c *memoryConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return nil
+}
+
+func (c *memoryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if query != memoryQuery {
+		if c.d.Exec != nil {
+			if err := c.d.Exec(query); err != nil {
+				return nil, err
+			}
+		}
+		return driver.RowsAffected(0), nil
+	}
+	var fn memoryFunc
+	switch op := args[0].Value.(type) {
+	case memoryFunc:
+		fn = op
+	case memoryRead:
+		fn = memoryFunc(op)
+	}
+	if c.tx != nil {
+		if err := fn(c.tx.tables); err != nil {
+			return nil, err
+		}
+		if _, ok := args[0].Value.(memoryFunc); ok {
+			// performed again when the transaction is committed
+			c.tx.ops = append(c.tx.ops, fn)
+		}
+		return driver.RowsAffected(0), nil
+	}
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	if err := fn(c.d.tables); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (tx *memoryTx) Commit() error {
+	tx.c.tx = nil
+	tx.c.d.mu.Lock()
+	defer tx.c.d.mu.Unlock()
+	for _, fn := range tx.ops {
+		if err := fn(tx.c.d.tables); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) Rollback() error {
+	tx.c.tx = nil
+	return nil
+}
@@ -0,0 +1,100 @@
+package migration
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newMemoryWorker creates a worker that uses drv, and records the
+// statements executed by migrations. Statements containing "fail" fail.
+func newMemoryWorker(t *testing.T, drv *MemoryDriver, schema *Schema) (*Worker, *[]string) {
+	t.Helper()
+	var stmts []string
+	drv.Exec = func(query string) error {
+		stmts = append(stmts, strings.Join(strings.Fields(query), " "))
+		if strings.Contains(query, "fail") {
+			return errors.New("simulated failure")
+		}
+		return nil
+	}
+	worker, err := NewWorkerWithDriver(drv.DB(), drv, schema)
+	wantNoError(t, err)
+	return worker, &stmts
+}
+
+func TestMemoryDriver(t *testing.T) {
+	ctx := context.Background()
+	for _, noTx := range []bool{false, true} {
+		drv := &MemoryDriver{NoTransactionalDDL: noTx}
+		worker, stmts := newMemoryWorker(t, drv, newTestSchema())
+
+		wantNoError(t, worker.Up(ctx))
+		wantNoError(t, worker.Lock(ctx, 10))
+		wantError(t, worker.Goto(ctx, 0), "database schema version locked id=10")
+		wantNoError(t, worker.Goto(ctx, 10))
+		want := []string{
+			"create table t1( id int primary key, name varchar(30) )",
+			"create table t2( id int primary key, name varchar(30) )",
+			"drop table t2",
+		}
+		if got := *stmts; !reflect.DeepEqual(got, want) {
+			t.Errorf("noTx=%v:\ngot=%q\nwant=%q", noTx, got, want)
+		}
+		status, err := worker.Status(ctx)
+		wantNoError(t, err)
+		if got, want := status.CurrentVersion, VersionID(10); got != want {
+			t.Errorf("noTx=%v: got=%d, want=%d", noTx, got, want)
+		}
+		if got, want := status.LockedVersions, []VersionID{10}; !reflect.DeepEqual(got, want) {
+			t.Errorf("noTx=%v: got=%v, want=%v", noTx, got, want)
+		}
+	}
+}
+
+func TestMemoryDriverFailure(t *testing.T) {
+	ctx := context.Background()
+
+	var schema Schema
+	schema.Define(1).Up(`create table t1(id int);`)
+	schema.Define(2).Up(`create table t2(id int); create table fail(id int);`)
+
+	// a failed migration in a transaction is rolled back
+	worker, _ := newMemoryWorker(t, &MemoryDriver{}, &schema)
+	wantError(t, worker.Up(ctx), "simulated failure")
+	status, err := worker.Status(ctx)
+	wantNoError(t, err)
+	if got, want := *status, (Status{CurrentVersion: 1, LatestVersion: 2, PendingCount: 1}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%+v, want=%+v", got, want)
+	}
+
+	// versions applied in a transaction that is rolled back are not recorded
+	worker, _ = newMemoryWorker(t, &MemoryDriver{}, &schema)
+	worker.AllInOneTransaction = true
+	wantError(t, worker.Up(ctx), "simulated failure")
+	status, err = worker.Status(ctx)
+	wantNoError(t, err)
+	if got, want := *status, (Status{LatestVersion: 2, PendingCount: 2}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%+v, want=%+v", got, want)
+	}
+
+	// a failed migration outside of a transaction requires repair
+	worker, _ = newMemoryWorker(t, &MemoryDriver{NoTransactionalDDL: true}, &schema)
+	wantError(t, worker.Up(ctx), "simulated failure")
+	ver, err := worker.Version(ctx, 2)
+	wantNoError(t, err)
+	if got, want := ver.Failed, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := ver.FailedStatement, 2; got != want {
+		t.Errorf("got=%d, want=%d", got, want)
+	}
+	wantNoError(t, worker.Recover(ctx, 2, MarkApplied))
+	status, err = worker.Status(ctx)
+	wantNoError(t, err)
+	if got, want := *status, (Status{CurrentVersion: 2, LatestVersion: 2}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%+v, want=%+v", got, want)
+	}
+}
@@ -30,6 +30,11 @@
 // be defined as a replay of the prevous "up" migration that created the previous version
 // of the view.
 //
+// If the down migration is not specified, it is derived from the up migration
+// where possible. In particular, when a view, trigger, function or procedure is
+// dropped and recreated, or created using "create or replace", the derived down
+// migration restores its previous version.
+//
 // Write migrations on separate branches
 //
 // Database schema versions are identified by positive 64-bit integers. Migrations
@@ -48,7 +53,8 @@
 //
 // Migrations are written as part of the Go source code, and are embedded in the
 // resulting executable without the need for any embedding utility, or the need to
-// deploy any separate text files.
+// deploy any separate text files. Migrations written as SQL files can be embedded
+// using an embed.FS: see NewSchemaFromFS.
 //
 // Deploy as part of a larger executable
 //
@@ -65,7 +71,9 @@
 package migration
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 )
@@ -104,15 +112,215 @@ func (e *Error) Error() string {
 	return fmt.Sprintf("%d: %s", e.Version, e.Description)
 }
 
+// Warnings describes possible problems in the migration schema definition
+// that do not prevent migrations from being performed. See Schema.Lint.
+type Warnings []*Warning
+
+// String returns the warnings, one per line.
+func (w Warnings) String() string {
+	s := make([]string, 0, len(w))
+	for _, warning := range w {
+		s = append(s, warning.String())
+	}
+	return strings.Join(s, "\n")
+}
+
+// A Warning describes a single possible problem in the migration
+// schema definition. Unlike an Error, it is not fatal.
+type Warning struct {
+	Version     VersionID
+	Description string
+}
+
+// String implements the fmt.Stringer interface.
+func (w *Warning) String() string {
+	return fmt.Sprintf("%d: %s", w.Version, w.Description)
+}
+
+// LockedError is returned when a migration cannot be performed because
+// it would migrate down past a locked version. Use the Unlock method to
+// unlock the version.
+type LockedError struct {
+	Version VersionID
+}
+
+// Error implements the error interface
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("database schema version locked id=%d", e.Version)
+}
+
+// StatementError is returned when a statement in an SQL migration fails.
+// It identifies the statement, which is useful for migrations containing
+// many statements. The statement is only identified if the statements in
+// the migration are executed one at a time (see Worker.SplitStatements),
+// or if the migration contains a single statement.
+type StatementError struct {
+	Version VersionID
+	Index   int    // index of the statement in the migration, starting at one
+	SQL     string // statement text, with comments removed
+	Err     error  // error reported by the database
+}
+
+// Error implements the error interface
+func (e *StatementError) Error() string {
+	return fmt.Sprintf("version %d statement %d failed: %s: %v", e.Version, e.Index, firstLine(e.SQL), e.Err)
+}
+
+// Unwrap returns the error reported by the database.
+func (e *StatementError) Unwrap() error {
+	return e.Err
+}
+
+// A RetryPolicy specifies how migrations performed in a transaction are
+// retried after a transient error, such as a lost connection during a
+// database failover. Migrations performed outside of a transaction are
+// never retried, because they may have been partly applied.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts to perform each
+	// migration, including the first attempt.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. The delay doubles
+	// for each subsequent retry, up to MaxBackoff if it is specified.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Retryable reports whether an error is transient, and the migration
+	// should be retried. If not specified, no errors are retried.
+	Retryable func(err error) bool
+}
+
+// retryable reports whether to retry after attempt failed with err.
+func (p *RetryPolicy) retryable(err error, attempt int) bool {
+	return p.Retryable != nil && attempt < p.MaxAttempts && p.Retryable(err)
+}
+
+// delay returns the delay before retrying after attempt failed.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return d
+}
+
+// ErrChecksumsNotRecorded is returned by Worker.VerifyChecksums if
+// versions have been applied, but none of them have a checksum, because
+// they were applied before checksums were recorded.
+var ErrChecksumsNotRecorded = errors.New("checksums not recorded")
+
 // VersionID uniquely identifies a database schema version.
 type VersionID int64
 
+// MaxVersionID is the highest database schema version. Versions are
+// positive, and version zero identifies an empty database.
+const MaxVersionID VersionID = math.MaxInt64
+
 // Version provides information about a database schema version.
+// The JSON field names are part of the API, and will not change.
 type Version struct {
-	ID        VersionID  // Database schema version number
-	AppliedAt *time.Time // Time migration was applied, or nil if not applied
-	Failed    bool       // Did migration fail
-	Locked    bool       // Is version locked (prevent down migration)
-	Up        string     // SQL for up migration, or "<go-func>" if go function
-	Down      string     // SQL for down migration or "<go-func>"" if a go function
+	ID              VersionID     `json:"version"`                    // Database schema version number
+	Description     string        `json:"description,omitempty"`      // Description of the version
+	AppliedAt       *time.Time    `json:"applied_at,omitempty"`       // Time migration was applied, or nil if not applied
+	Failed          bool          `json:"failed"`                     // Did migration fail
+	Locked          bool          `json:"locked"`                     // Is version locked (prevent down migration)
+	NoTx            bool          `json:"no_tx,omitempty"`            // Is migration always performed outside of a transaction
+	Duration        time.Duration `json:"duration,omitempty"`         // Time taken to perform the up migration
+	Checksum        string        `json:"checksum,omitempty"`         // Checksum of the up migration
+	FailedStatement int           `json:"failed_statement,omitempty"` // Statement that failed in a non-transactional migration, starting at one
+	AppliedBy       string        `json:"applied_by,omitempty"`       // Application or host that applied the migration
+	Up              string        `json:"up"`                         // SQL for up migration, or "<go-func>" if go function
+	Down            string        `json:"down"`                       // SQL for down migration or "<go-func>"" if a go function
+}
+
+// A Logger is a structured logger. Messages are logged along with alternating
+// key/value pairs, such as "version" and the database schema version.
+//
+// The *slog.Logger type in the standard library implements Logger.
+type Logger interface {
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+}
+
+// Status summarizes the migration state of a database.
+type Status struct {
+	CurrentVersion VersionID   // Highest applied version, or zero if none applied
+	LatestVersion  VersionID   // Highest version defined in the schema
+	PendingCount   int         // Number of versions not yet applied
+	HasFailed      bool        // Has a migration failed, requiring manual repair
+	LockedVersions []VersionID // Locked versions, in ascending order
+}
+
+// Outcome is the outcome of a failed migration, as determined by the
+// operator who has inspected the database. See Worker.Recover.
+type Outcome int
+
+// Outcomes of a failed migration.
+const (
+	// MarkApplied indicates that the failed migration has been completed
+	// manually, so the version should be recorded as applied.
+	MarkApplied Outcome = iota + 1
+
+	// MarkRolledBack indicates that the effects of the failed migration
+	// have been reversed manually, so the version should be recorded as
+	// not applied.
+	MarkRolledBack
+)
+
+// String implements the fmt.Stringer interface.
+func (o Outcome) String() string {
+	switch o {
+	case MarkApplied:
+		return "applied"
+	case MarkRolledBack:
+		return "rolled back"
+	}
+	return fmt.Sprintf("Outcome(%d)", int(o))
+}
+
+// Direction indicates whether a migration is up or down.
+type Direction int
+
+// Migration directions.
+const (
+	DirectionUp Direction = iota + 1
+	DirectionDown
+)
+
+// String implements the fmt.Stringer interface.
+func (d Direction) String() string {
+	switch d {
+	case DirectionUp:
+		return "up"
+	case DirectionDown:
+		return "down"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// Result describes the outcome of a migration operation.
+type Result struct {
+	StartVersion VersionID     // Database schema version before migrating
+	EndVersion   VersionID     // Database schema version after migrating
+	Applied      []VersionID   // Versions migrated up, in the order performed
+	Reverted     []VersionID   // Versions migrated down, in the order performed
+	Duration     time.Duration // Time taken to perform the migrations
+}
+
+// add records a version migrated up or down. A zero id is ignored.
+func (r *Result) add(id VersionID, up bool) {
+	if id == 0 {
+		return
+	}
+	if up {
+		r.Applied = append(r.Applied, id)
+	} else {
+		r.Reverted = append(r.Reverted, id)
+	}
 }
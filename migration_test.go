@@ -1,6 +1,10 @@
 package migration
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
 
 func TestErrors(t *testing.T) {
 	tests := []struct {
@@ -28,3 +32,30 @@ func TestErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestVersionJSON(t *testing.T) {
+	appliedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		ver  Version
+		want string
+	}{
+		{
+			ver:  Version{ID: 1, Up: "create table t1(id int);", Down: "drop table t1;"},
+			want: `{"version":1,"failed":false,"locked":false,"up":"create table t1(id int);","down":"drop table t1;"}`,
+		},
+		{
+			ver:  Version{ID: 2, AppliedAt: &appliedAt, Locked: true},
+			want: `{"version":2,"applied_at":"2020-01-02T03:04:05Z","failed":false,"locked":true,"up":"","down":""}`,
+		},
+	}
+	for tn, tt := range tests {
+		b, err := json.Marshal(&tt.ver)
+		if err != nil {
+			t.Errorf("%d: got=%v, want=nil", tn, err)
+			continue
+		}
+		if got, want := string(b), tt.want; got != want {
+			t.Errorf("%d:\ngot=%v\nwant=%v", tn, got, want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Package migrationtest provides helpers for testing database migrations.
+//
+// Each helper creates a migration worker that keeps track of migrations in
+// a uniquely named migrations table, so that tests using a shared database
+// do not interfere with each other's migration history. Note that only the
+// migrations table is unique: the tables, views, etc created by the
+// migrations are not renamed, so tests that run in parallel on a shared
+// database should use migrations that create distinct database objects.
+//
+// The simplest way to use this package is to call NewWorker, which drops
+// the migrations table using t.Cleanup when the test completes:
+//
+//	func TestMigrations(t *testing.T) {
+//		db := openTestDB(t)
+//		worker := migrationtest.NewWorker(t, db, schema)
+//		if err := worker.Up(context.Background()); err != nil {
+//			t.Fatal(err)
+//		}
+//		t.Cleanup(func() {
+//			// runs before the migrations table is dropped
+//			worker.Goto(context.Background(), 0)
+//		})
+//		// ... test the migrated database
+//	}
+//
+// Cleanup functions are called in last-added, first-called order, so a
+// cleanup function registered after calling NewWorker can use the worker
+// to migrate down before the migrations table is dropped.
+package migrationtest
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"testing"
+
+	"github.com/jjeffery/migration"
+)
+
+// NewWorker creates a worker that performs the migrations in schema using
+// a uniquely named migrations table. The migrations table is dropped when
+// the test and all its subtests complete. If the worker cannot be created,
+// the test fails immediately.
+func NewWorker(t testing.TB, db *sql.DB, schema *migration.Schema) *migration.Worker {
+	t.Helper()
+	worker, tblname, err := newWorker(db, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := dropTable(context.Background(), db, tblname); err != nil {
+			t.Error(err)
+		}
+	})
+	return worker
+}
+
+// Run creates a worker that performs the migrations in schema using a
+// uniquely named migrations table, and calls fn with the worker. The
+// migrations table is dropped after fn returns. Run returns the error
+// returned by fn, if any.
+func Run(ctx context.Context, db *sql.DB, schema *migration.Schema, fn func(w *migration.Worker) error) error {
+	worker, tblname, err := newWorker(db, schema)
+	if err != nil {
+		return err
+	}
+	err = fn(worker)
+	if dropErr := dropTable(ctx, db, tblname); err == nil {
+		err = dropErr
+	}
+	return err
+}
+
+// OpenMemory opens an in-memory SQLite database for a test, which is closed
+// when the test and all its subtests complete. Each connection to an
+// in-memory database opens a separate, empty database, so the connection
+// pool is limited to one connection. The test program must import a
+// database/sql driver registered as "sqlite3", such as
+// github.com/mattn/go-sqlite3. If the database cannot be opened,
+// the test fails immediately.
+func OpenMemory(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+// TableName returns a unique name for a migrations table.
+func TableName() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return migration.DefaultMigrationsTable + "_" + hex.EncodeToString(b[:])
+}
+
+// newWorker creates a worker for schema that uses
+// a uniquely named migrations table.
+func newWorker(db *sql.DB, schema *migration.Schema) (*migration.Worker, string, error) {
+	tblname := TableName()
+	worker, err := migration.NewWorker(db, schema, migration.WithMigrationsTable(tblname))
+	if err != nil {
+		return nil, "", err
+	}
+	return worker, tblname, nil
+}
+
+// dropTable drops the migrations table. The name is generated by
+// TableName, so it is safe to include in the statement.
+func dropTable(ctx context.Context, db *sql.DB, tblname string) error {
+	_, err := db.ExecContext(ctx, "drop table if exists "+tblname)
+	return err
+}
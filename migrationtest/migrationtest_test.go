@@ -0,0 +1,114 @@
+package migrationtest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/jjeffery/migration"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestSchema() *migration.Schema {
+	var schema migration.Schema
+	schema.Define(1).Up(`create table t1(id int primary key);`)
+	schema.Define(2).Up(`create table t2(id int primary key);`)
+	return &schema
+}
+
+func tableExists(t *testing.T, db *sql.DB, tblname string) bool {
+	t.Helper()
+	var count int
+	err := db.QueryRow(`select count(*) from sqlite_master where type = 'table' and name = ?`, tblname).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestNewWorker(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	schema := newTestSchema()
+	t.Run("migrate", func(t *testing.T) {
+		worker := NewWorker(t, db, schema)
+		if err := worker.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := worker.Goto(ctx, 0); err != nil {
+				t.Error(err)
+			}
+		})
+		if !tableExists(t, db, "t2") {
+			t.Error("want table t2 to exist")
+		}
+	})
+
+	// the migrations table was dropped after migrating down
+	var count int
+	err = db.QueryRow(`select count(*) from sqlite_master where type = 'table'`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := count, 0; got != want {
+		t.Errorf("got=%d tables, want=%d", got, want)
+	}
+
+	if schema.MigrationsTable != "" {
+		t.Errorf("want schema unchanged, got MigrationsTable=%q", schema.MigrationsTable)
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	var tblname string
+	err = Run(ctx, db, newTestSchema(), func(w *migration.Worker) error {
+		if err := w.Up(ctx); err != nil {
+			return err
+		}
+		versions, err := w.Versions(ctx)
+		if err != nil {
+			return err
+		}
+		if got, want := len(versions), 2; got != want {
+			t.Errorf("got=%d, want=%d", got, want)
+		}
+		err = db.QueryRow(`select name from sqlite_master where name like 'schema_migrations_%'`).Scan(&tblname)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tableExists(t, db, tblname) {
+		t.Errorf("want table %s dropped", tblname)
+	}
+}
+
+func TestOpenMemory(t *testing.T) {
+	ctx := context.Background()
+	db := OpenMemory(t)
+	if got, want := db.Stats().MaxOpenConnections, 1; got != want {
+		t.Errorf("got=%d, want=%d", got, want)
+	}
+	worker := NewWorker(t, db, newTestSchema())
+	if err := worker.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !tableExists(t, db, "t2") {
+		t.Error("table t2 does not exist")
+	}
+}
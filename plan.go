@@ -2,22 +2,72 @@ package migration
 
 import (
 	"fmt"
+	"sync"
 )
 
 // a migrationPlan contains the information required to
 // migrate to a version from the previous version, and back
 // down again.
 type migrationPlan struct {
-	id   VersionID
-	up   action
-	down action
-	errs Errors
+	id          VersionID
+	description string
+	up          action
+	down        action
+	verify      action // check after the up migration
+	downDerived bool
+	downSource  string // derived down SQL formatted for display
+	checksum    string // checksum of the up migration
+	errs        Errors
+
+	// The down migration is completed by completeDown, which is
+	// deferred until first use if Schema.LazyDown is set.
+	downOnce    sync.Once
+	downPending bool             // down migration is to be derived from the up migration
+	downHistory []*migrationPlan // previous plans, for deriving the down migration
+	downErr     *Error           // down migration cannot be derived
+
+	// Derived down migrations that drop objects in a style other than
+	// the default are derived when first used, and cached.
+	downMu      sync.Mutex
+	downPrevSQL []string             // up SQL of previous versions
+	downStyles  map[dropStyle]string // derived down SQL for each style
+}
+
+// A PlanItem describes the migration plan for a single version,
+// as reported by Schema.Plan.
+type PlanItem struct {
+	ID          VersionID
+	Description string
+
+	// UpSQL and DownSQL contain the SQL for migrating up to the
+	// version and back down again. They are empty if the migration
+	// is performed by a Go function.
+	UpSQL   string
+	DownSQL string
+
+	// UpFunc and DownFunc report whether the migrations are
+	// performed by a Go function (DBFunc or TxFunc).
+	UpFunc   bool
+	DownFunc bool
+
+	// DownDerived reports whether DownSQL was derived from the
+	// up migration, rather than being specified in the definition.
+	DownDerived bool
+
+	// NoTx reports whether the up or down migration is always
+	// performed outside of a transaction. See Definition.NoTx.
+	NoTx bool
 }
 
-func newPlan(def *Definition, plans map[VersionID]*migrationPlan) *migrationPlan {
+// newPlan creates a plan for the definition. The plans for all previous
+// versions are available in plans, and in the order they are applied
+// in history. If lazyDown is set, the down migration is not completed
+// until it is first used.
+func newPlan(def *Definition, plans map[VersionID]*migrationPlan, history []*migrationPlan, lazyDown bool) *migrationPlan {
 	p := &migrationPlan{
-		id:   def.id,
-		errs: def.errs(),
+		id:          def.id,
+		description: def.description,
+		errs:        def.errs(),
 	}
 
 	if def.upAction != nil {
@@ -53,5 +103,143 @@ func newPlan(def *Definition, plans map[VersionID]*migrationPlan) *migrationPlan
 	replayUp(&p.up)
 	replayUp(&p.down)
 
+	if def.verify != nil {
+		def.verify(&p.verify)
+		if p.verify.txFunc == nil && p.verify.dbFunc == nil {
+			addError("verify must be defined using TxFunc or DBFunc")
+		}
+	}
+
+	if def.downCount == 0 {
+		if p.up.dbFunc == nil && p.up.txFunc == nil && p.up.sql != "" {
+			p.downPending = true
+			p.downHistory = history
+		} else {
+			addError("down migration not defined")
+		}
+	}
+
+	p.up.noTx = p.up.noTx || def.noTx || requiresNoTx(p.up.sql)
+	p.down.noTx = p.down.noTx || def.noTx
+	p.checksum = p.up.checksum()
+
+	if !lazyDown {
+		if p.completeDown(); p.downErr != nil {
+			p.errs = append(p.errs, p.downErr)
+		}
+	}
+
 	return p
 }
+
+// completeDown completes the down migration, which involves parsing its
+// SQL, and deriving it from the up migration if it is not defined. This
+// is only done once, and sets downErr if the down migration cannot be
+// derived.
+func (p *migrationPlan) completeDown() {
+	p.downOnce.Do(func() {
+		if p.downPending {
+			p.deriveDown()
+			p.downHistory = nil
+		}
+		p.down.noTx = p.down.noTx || requiresNoTx(p.down.sql)
+	})
+}
+
+// deriveDown attempts to derive the down migration from the up migration.
+// If it cannot be derived, downErr is set to a single error for the version,
+// which lists the statements that cannot be reversed.
+func (p *migrationPlan) deriveDown() {
+	var prevSQL []string
+	for _, prev := range p.downHistory {
+		if prev.up.sql != "" {
+			prevSQL = append(prevSQL, prev.up.sql)
+		}
+	}
+	down, err := deriveDownSQLRestore(p.up.sql, prevSQL, dropStyle{})
+	if err != nil {
+		p.downErr = &Error{
+			Version:     p.id,
+			Description: "down migration not defined: " + err.Error(),
+		}
+		return
+	}
+	p.down.sql = down
+	p.downDerived = true
+	p.downSource = formatDownSQL(down)
+	p.downPrevSQL = prevSQL
+}
+
+// styledDown returns the derived down SQL that drops objects in the
+// specified style, or an empty string if the down migration is not
+// derived.
+func (p *migrationPlan) styledDown(style dropStyle) string {
+	p.completeDown()
+	if !p.downDerived || style == (dropStyle{}) {
+		return ""
+	}
+	p.downMu.Lock()
+	defer p.downMu.Unlock()
+	down, ok := p.downStyles[style]
+	if !ok {
+		// cannot fail, because the default style was derived
+		down, _ = deriveDownSQLRestore(p.up.sql, p.downPrevSQL, style)
+		if p.downStyles == nil {
+			p.downStyles = make(map[dropStyle]string)
+		}
+		p.downStyles[style] = down
+	}
+	return down
+}
+
+// downError completes the down migration, and returns an error if
+// it cannot be derived from the up migration.
+func (p *migrationPlan) downError() error {
+	if p.completeDown(); p.downErr != nil {
+		return p.downErr
+	}
+	return nil
+}
+
+// item returns the public description of the plan.
+func (p *migrationPlan) item() PlanItem {
+	p.completeDown()
+	return PlanItem{
+		ID:          p.id,
+		Description: p.description,
+		UpSQL:       p.up.sql,
+		DownSQL:     p.down.sql,
+		UpFunc:      p.up.dbFunc != nil || p.up.txFunc != nil,
+		DownFunc:    p.down.dbFunc != nil || p.down.txFunc != nil,
+		DownDerived: p.downDerived,
+		NoTx:        p.noTx(),
+	}
+}
+
+// noTx reports whether the up or down migration is always
+// performed outside of a transaction.
+func (p *migrationPlan) noTx() bool {
+	p.completeDown()
+	return p.up.noTx || p.down.noTx
+}
+
+// downSQL returns the SQL for the down migration. Derived down
+// migrations drop objects in the specified style.
+func (p *migrationPlan) downSQL(style dropStyle) string {
+	if down := p.styledDown(style); down != "" {
+		return down
+	}
+	return p.down.sql
+}
+
+// downDescription returns the down migration for display. Derived
+// down migrations are formatted to be easier to read.
+func (p *migrationPlan) downDescription(style dropStyle) string {
+	if down := p.styledDown(style); down != "" {
+		return formatDownSQL(down)
+	}
+	if p.downSource != "" {
+		return p.downSource
+	}
+	return p.down.description()
+}
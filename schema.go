@@ -1,7 +1,13 @@
 package migration
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 // A Schema contains all of the information required to perform database
@@ -13,8 +19,32 @@ type Schema struct {
 	// to keep track of the database migrations performed.
 	//
 	// If not specified, defaults to the constant DefaultMigrationsTable.
+	//
+	// The name can include a schema prefix, eg "admin.schema_migrations",
+	// in which case the schema must already exist. Each part of the name
+	// must be an identifier consisting of letters, digits and underscores.
 	MigrationsTable string
 
+	// Name identifies an independent stream of migrations, for use when
+	// more than one schema, each with its own version sequence, is
+	// migrated in the same database. If specified, the name is appended
+	// to the migrations table name, separated by an underscore, so that
+	// each stream keeps track of its versions in a separate table. For
+	// example, a schema named "analytics" uses the migrations table
+	// "schema_migrations_analytics" by default.
+	//
+	// The name must consist of letters, digits and underscores.
+	Name string
+
+	// LazyDown specifies that down migrations are not derived from the
+	// up migrations until they are needed, for example when migrating
+	// down, or when calling Plan or Worker.Versions. This reduces the
+	// time taken to check the schema and migrate up when there are many
+	// versions. Err does not report versions whose down migration cannot
+	// be derived: the error is reported when the down migration is needed.
+	// Tests should check the schema using Err with LazyDown unset.
+	LazyDown bool
+
 	definitions map[VersionID]*Definition
 	plans       []*migrationPlan
 	errs        Errors
@@ -24,11 +54,20 @@ type Schema struct {
 // from the previous version and the migration down to the
 // previous version.
 //
+// The version must be between 1 and MaxVersionID, because version
+// zero identifies an empty database.
+//
 // This method is typically called at program initialization, once
 // for each database schema version. See the package example.
 func (s *Schema) Define(id VersionID) *Definition {
 	d := newDefinition(id)
-	if _, ok := s.definitions[id]; ok {
+	if id <= 0 {
+		// version zero means an empty database, see Worker.Goto
+		s.errs = append(s.errs, &Error{
+			Version:     id,
+			Description: "version is not positive",
+		})
+	} else if _, ok := s.definitions[id]; ok {
 		s.errs = append(s.errs, &Error{
 			Version:     id,
 			Description: "defined more than once",
@@ -46,6 +85,58 @@ func (s *Schema) Define(id VersionID) *Definition {
 	return d
 }
 
+// MustDefine is like Define, but panics if the version is not positive,
+// or has already been defined. It is intended for use in package
+// initialization, where a panic is an acceptable response to a
+// programming error.
+func (s *Schema) MustDefine(id VersionID) *Definition {
+	if id <= 0 {
+		panic(fmt.Sprintf("migration: version %d is not positive", id))
+	}
+	if _, ok := s.definitions[id]; ok {
+		panic(fmt.Sprintf("migration: version %d defined more than once", id))
+	}
+	return s.Define(id)
+}
+
+// Merge adds the version definitions in other to the schema. This is
+// useful when an application is composed of several packages, each of
+// which defines the migrations for its own database objects.
+//
+// Merging a version that is already defined in the schema is an error,
+// which is reported by the returned value and also by the Err method.
+// Any errors in other are also reported by the Err method.
+// The MigrationsTable of other is ignored.
+func (s *Schema) Merge(other *Schema) error {
+	var errs Errors
+	for id, d := range other.definitions {
+		if _, ok := s.definitions[id]; ok {
+			errs = append(errs, &Error{
+				Version:     id,
+				Description: "defined more than once",
+			})
+			continue
+		}
+		if s.definitions == nil {
+			s.definitions = make(map[VersionID]*Definition)
+		}
+		s.definitions[id] = d
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Version < errs[j].Version
+	})
+	s.errs = append(s.errs, other.errs...)
+	s.errs = append(s.errs, errs...)
+
+	// plans are no longer valid after definitions are added
+	s.plans = nil
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
 // Err reports a non-nil error if there are any errors in the
 // migration schema definition, otherwise it returns nil.
 //
@@ -72,6 +163,257 @@ func (s *Schema) Err() error {
 	return nil
 }
 
+// Validate reports a non-nil error if there are any errors in the
+// migration schema definition. It is an alias for Err.
+func (s *Schema) Validate() error {
+	return s.Err()
+}
+
+// lintGapFactor is the factor by which a gap between consecutive versions
+// must exceed the median gap to be reported by Lint.
+const lintGapFactor = 1000
+
+// Lint reports possible problems in the migration schema definition that do
+// not prevent migrations from being performed, so they are not reported by
+// Err. These include versions with the same description, which can happen
+// when the same migration is merged from two branches with different version
+// numbers, and unusually large gaps between consecutive versions. Lint
+// returns nil if there are no warnings.
+func (s *Schema) Lint() Warnings {
+	ids := make([]VersionID, 0, len(s.definitions))
+	for id := range s.definitions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	var warnings Warnings
+	addWarning := func(id VersionID, format string, args ...interface{}) {
+		warnings = append(warnings, &Warning{
+			Version:     id,
+			Description: fmt.Sprintf(format, args...),
+		})
+	}
+
+	descriptions := make(map[string]VersionID)
+	for _, id := range ids {
+		desc := strings.ToLower(strings.TrimSpace(s.definitions[id].description))
+		if desc == "" {
+			continue
+		}
+		if prev, ok := descriptions[desc]; ok {
+			addWarning(id, "same description as version %d: %s", prev, s.definitions[id].description)
+		} else {
+			descriptions[desc] = id
+		}
+	}
+
+	if len(ids) >= 3 {
+		gaps := make([]VersionID, 0, len(ids)-1)
+		for i := 1; i < len(ids); i++ {
+			gaps = append(gaps, ids[i]-ids[i-1])
+		}
+		sorted := append([]VersionID(nil), gaps...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i] < sorted[j]
+		})
+		median := sorted[len(sorted)/2]
+		for i, gap := range gaps {
+			if gap > median*lintGapFactor {
+				addWarning(ids[i+1], "gap of %d after version %d", gap, ids[i])
+			}
+		}
+	}
+
+	return warnings
+}
+
+// Plan returns the migration plan for each version in the schema,
+// in the order the versions are applied, which is ascending order of
+// version unless changed by Definition.DependsOn. The plan includes any down migrations
+// derived from the up migrations, so it is useful for checking that
+// derived down migrations are correct without performing any migrations.
+func (s *Schema) Plan() []PlanItem {
+	s.complete()
+	items := make([]PlanItem, 0, len(s.plans))
+	for _, p := range s.plans {
+		items = append(items, p.item())
+	}
+	return items
+}
+
+// DumpUp writes the up migrations for every version in the schema to w,
+// in the order they are applied, as a script that builds the database
+// schema. Each version is preceded by a comment that identifies it.
+// Migrations performed by a Go function are written as a comment.
+//
+// If there are any errors in the migration schema definition, they are
+// returned and nothing is written.
+func (s *Schema) DumpUp(w io.Writer) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return dumpActions(w, s.plans, func(p *migrationPlan) (*action, string) {
+		return &p.up, p.up.sql
+	})
+}
+
+// DumpDown writes the down migrations for every version in the schema to
+// w, in the order they are applied when migrating down, as a script that
+// removes the database schema. Down migrations that are derived from the
+// up migrations are included. Otherwise DumpDown is the same as DumpUp.
+func (s *Schema) DumpDown(w io.Writer) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	var errs Errors
+	for _, p := range s.plans {
+		if p.completeDown(); p.downErr != nil {
+			// only possible if LazyDown is set
+			errs = append(errs, p.downErr)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	plans := make([]*migrationPlan, 0, len(s.plans))
+	for i := len(s.plans) - 1; i >= 0; i-- {
+		plans = append(plans, s.plans[i])
+	}
+	return dumpActions(w, plans, func(p *migrationPlan) (*action, string) {
+		return &p.down, p.downDescription(dropStyle{})
+	})
+}
+
+// GenerateSquash writes to w the Go source for a definition of version
+// upTo that performs the up migrations of all versions up to and including
+// upTo in a single migration, along with instructions for using it. This
+// is useful when a schema has so many versions that building a new
+// database takes too long. Replacing the definitions of the squashed versions
+// with the generated definition does not affect databases that have already
+// been migrated past upTo.
+//
+// The squashed versions must be applied before any later versions, and must
+// not be performed by Go functions.
+func (s *Schema) GenerateSquash(upTo VersionID, w io.Writer) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if _, ok := s.definitions[upTo]; !ok {
+		return fmt.Errorf("cannot squash: version %d is not defined", upTo)
+	}
+	var plans []*migrationPlan
+	for i, p := range s.plans {
+		if p.id > upTo {
+			for _, later := range s.plans[i+1:] {
+				if later.id <= upTo {
+					return fmt.Errorf("cannot squash version %d: it is applied after version %d", later.id, p.id)
+				}
+			}
+			break
+		}
+		if p.up.dbFunc != nil || p.up.txFunc != nil {
+			return fmt.Errorf("cannot squash version %d: it is performed by a Go function", p.id)
+		}
+		plans = append(plans, p)
+	}
+	var sb strings.Builder
+	err := dumpActions(&sb, plans, func(p *migrationPlan) (*action, string) {
+		return &p.up, p.up.sql
+	})
+	if err != nil {
+		return err
+	}
+	upSQL := sb.String()
+	first := plans[0].id
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Versions %d to %d squashed into a single migration.\n", first, upTo)
+	b.WriteString("//\n")
+	fmt.Fprintf(&b, "// Replace the definitions of versions %d to %d with this definition.\n", first, upTo)
+	fmt.Fprintf(&b, "// New databases are migrated to version %d in a single migration.\n", upTo)
+	fmt.Fprintf(&b, "// Databases that have already applied version %d are not affected,\n", upTo)
+	b.WriteString("// except that Worker.Up reports a checksum mismatch because the up\n")
+	b.WriteString("// migration has changed. Before deploying, clear the checksum with:\n")
+	fmt.Fprintf(&b, "//  update %s set checksum = null where id = %d;\n", s.migrationsTable(), upTo)
+	if len(plans) > 1 {
+		fmt.Fprintf(&b, "// Schema.ValidateAgainst reports versions %d to %d as applied to those\n", first, plans[len(plans)-2].id)
+		b.WriteString("// databases but not defined in the schema.\n")
+	}
+	if _, err := deriveDownSQL(upSQL); err != nil {
+		fmt.Fprintf(&b, "//\n// The down migration must be defined, because %v.\n", err)
+	}
+	fmt.Fprintf(&b, "schema.Define(%d).\n", upTo)
+	fmt.Fprintf(&b, "\tDescribe(%s).\n", strconv.Quote(fmt.Sprintf("versions %d to %d squashed", first, upTo)))
+	var noTx bool
+	for _, p := range plans {
+		noTx = noTx || p.up.noTx
+	}
+	if noTx {
+		b.WriteString("\tNoTx().\n")
+	}
+	if strings.Contains(upSQL, "`") {
+		fmt.Fprintf(&b, "\tUp(%s)\n", strconv.Quote(upSQL))
+	} else {
+		fmt.Fprintf(&b, "\tUp(`\n%s`)\n", upSQL)
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// dumpActions writes the SQL for one action of each plan to w. The
+// actionFor function returns the action and the SQL to write.
+func dumpActions(w io.Writer, plans []*migrationPlan, actionFor func(p *migrationPlan) (*action, string)) error {
+	var sb strings.Builder
+	for i, p := range plans {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "-- Version %d", p.id)
+		if p.description != "" {
+			fmt.Fprintf(&sb, ": %s", p.description)
+		}
+		sb.WriteString("\n")
+		a, sql := actionFor(p)
+		if a.dbFunc != nil || a.txFunc != nil {
+			fmt.Fprintf(&sb, "-- performed by a Go function %s\n", a.description())
+			continue
+		}
+		sb.WriteString(strings.TrimSpace(sql))
+		sb.WriteString("\n")
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// ValidateAgainst checks that every version applied to the database is
+// defined in the schema. This detects when the database has been migrated
+// by a newer version of the program, which has then been rolled back.
+// It reports an error of type Errors listing each unknown version.
+//
+// ValidateAgainst does not perform any migrations, and does not create the
+// migrations table if it does not exist.
+func (s *Schema) ValidateAgainst(ctx context.Context, db *sql.DB) error {
+	worker, err := NewWorker(db, s)
+	if err != nil {
+		return err
+	}
+	return worker.checkApplied(ctx)
+}
+
+// migrationsTable returns the name of the migrations table for the schema.
+func (s *Schema) migrationsTable() string {
+	tn := s.MigrationsTable
+	if tn == "" {
+		tn = DefaultMigrationsTable
+	}
+	if s.Name != "" {
+		tn += "_" + s.Name
+	}
+	return tn
+}
+
 func (s *Schema) complete() {
 	if s.plans != nil {
 		// already complete
@@ -90,12 +432,72 @@ func (s *Schema) complete() {
 	sort.Slice(ids, func(i, j int) bool {
 		return ids[i] < ids[j]
 	})
+	ids, depErrs := orderDependencies(ids, s.definitions)
 
 	plans := make(map[VersionID]*migrationPlan)
 	for _, id := range ids {
 		d := s.definitions[id]
-		p := newPlan(d, plans)
+		p := newPlan(d, plans, s.plans, s.LazyDown)
+		p.errs = append(p.errs, depErrs[id]...)
 		s.plans = append(s.plans, p)
 		plans[id] = p
 	}
 }
+
+// orderDependencies orders the version ids so that each version follows
+// the versions it depends on. Otherwise the versions remain in ascending
+// order. Versions that depend on undefined versions, or that cannot be
+// ordered because of a dependency cycle, are reported as errors.
+func orderDependencies(ids []VersionID, defs map[VersionID]*Definition) ([]VersionID, map[VersionID]Errors) {
+	errs := make(map[VersionID]Errors)
+	addError := func(id VersionID, s string) {
+		errs[id] = append(errs[id], &Error{Version: id, Description: s})
+	}
+
+	var hasDeps bool
+	for _, id := range ids {
+		for _, dep := range defs[id].dependsOn {
+			hasDeps = true
+			if _, ok := defs[dep]; !ok {
+				addError(id, fmt.Sprintf("depends on undefined version %d", dep))
+			}
+		}
+	}
+	if !hasDeps {
+		return ids, errs
+	}
+
+	// Repeatedly choose the lowest version whose dependencies have all
+	// been placed. This is quadratic, but the number of versions is small.
+	ordered := make([]VersionID, 0, len(ids))
+	placed := make(map[VersionID]bool, len(ids))
+	remaining := ids
+	for len(remaining) > 0 {
+		next := -1
+		for i, id := range remaining {
+			ready := true
+			for _, dep := range defs[id].dependsOn {
+				if _, ok := defs[dep]; ok && !placed[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			// the remaining versions depend on a cycle
+			for _, id := range remaining {
+				addError(id, "dependency cycle")
+			}
+			return append(ordered, remaining...), errs
+		}
+		id := remaining[next]
+		ordered = append(ordered, id)
+		placed[id] = true
+		remaining = append(remaining[:next:next], remaining[next+1:]...)
+	}
+	return ordered, errs
+}
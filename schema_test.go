@@ -3,6 +3,7 @@ package migration
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
@@ -31,6 +32,16 @@ func TestSchemaErrors(t *testing.T) {
 				"1: defined more than once",
 			},
 		},
+		{
+			fn: func(s *Schema) {
+				s.Define(0).Up(`create table t1(id int);`)
+				s.Define(-1).Up(`create table t2(id int);`)
+			},
+			errs: []string{
+				"0: version is not positive",
+				"-1: version is not positive",
+			},
+		},
 		{
 			fn: func(s *Schema) {
 				s.Define(1).Down("do something")
@@ -89,7 +100,48 @@ func TestSchemaErrors(t *testing.T) {
 				s.Define(2).Up("some DDL command")
 			},
 			errs: []string{
-				"2: down migration not defined",
+				"2: down migration not defined: cannot reverse statement: some DDL command",
+			},
+		},
+		{
+			fn: func(s *Schema) {
+				s.Define(1).Up(`
+					create table t1(id int);
+					create view v1 as select id from t1;
+				`)
+				s.Define(2).Up(`
+					create table t2(id int);
+					insert into t2(id) values(1);
+					update t1 set id = 2;
+				`)
+			},
+			errs: []string{
+				"2: down migration not defined: cannot reverse statements: insert into t2(id) values(1); update t1 set id = 2",
+			},
+		},
+		{
+			fn: func(s *Schema) {
+				s.Define(1).Up("create table t1(id int);")
+				s.Define(2).Up("alter table t1 add column name text;")
+			},
+		},
+		{
+			fn: func(s *Schema) {
+				s.Define(1).Up("create table t1(id int);")
+				s.Define(2).Up("drop table t1;").Down("create table t1(id int);")
+				s.Define(3).Up("drop table t1;").
+					DownAction(DBFunc(func(ctx context.Context, db *sql.DB) error { return nil }))
+				s.Define(4).Up("drop table t1;").
+					DownAction(TxFunc(func(ctx context.Context, tx *sql.Tx) error { return nil }))
+			},
+		},
+		{
+			fn: func(s *Schema) {
+				s.Define(1).Up("create table t1(id int);")
+				s.Define(2).Up("drop table t1;")
+			},
+			errs: []string{
+				"2: down migration not defined: cannot reverse statement: drop table t1",
 			},
 		},
 		{
@@ -110,6 +162,42 @@ func TestSchemaErrors(t *testing.T) {
 				"9: replay must specify an earlier version",
 			},
 		},
+		{
+			fn: func(s *Schema) {
+				s.Define(1).Up(`create table t1(id int);`).Verify(Command(`select 1`))
+			},
+			errs: []string{
+				"1: verify must be defined using TxFunc or DBFunc",
+			},
+		},
+		{
+			fn: func(s *Schema) {
+				verify := DBFunc(func(ctx context.Context, db *sql.DB) error { return nil })
+				s.Define(1).Up(`create table t1(id int);`).Verify(verify).Verify(verify)
+			},
+			errs: []string{
+				"1: verify defined 2 times",
+			},
+		},
+		{
+			fn: func(s *Schema) {
+				s.Define(1).Up(`create table t1(id int);`).DependsOn(5)
+			},
+			errs: []string{
+				"1: depends on undefined version 5",
+			},
+		},
+		{
+			fn: func(s *Schema) {
+				s.Define(1).Up(`create table t1(id int);`)
+				s.Define(2).Up(`create table t2(id int);`).DependsOn(3)
+				s.Define(3).Up(`create table t3(id int);`).DependsOn(2)
+			},
+			errs: []string{
+				"2: dependency cycle",
+				"3: dependency cycle",
+			},
+		},
 	}
 
 	for tn, tt := range tests {
@@ -141,6 +229,322 @@ func TestSchemaCannotCreateNewCommand(t *testing.T) {
 	}
 }
 
+func TestSchemaMerge(t *testing.T) {
+	var s1, s2, s3 Schema
+	s1.Define(1).Up(`create table t1(id int);`)
+	s1.Define(3).Up(`create table t3(id int);`)
+	s2.Define(2).Up(`create table t2(id int);`)
+	s2.Define(4).Up(`create table t4(id int);`)
+	s3.Define(3).Up(`create table t3a(id int);`)
+
+	wantNoError(t, s1.Merge(&s2))
+	wantNoError(t, s1.Err())
+
+	var ids []VersionID
+	for _, p := range s1.plans {
+		ids = append(ids, p.id)
+	}
+	if got, want := ids, []VersionID{1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	err := s1.Merge(&s3)
+	wantError(t, err, "3: defined more than once")
+	wantError(t, s1.Err(), "3: defined more than once")
+}
+
+func TestSchemaMustDefine(t *testing.T) {
+	var s Schema
+	s.MustDefine(1).Up(`create table t1(id int);`)
+	wantNoError(t, s.Validate())
+
+	defer func() {
+		if got, want := fmt.Sprint(recover()), "migration: version 1 defined more than once"; got != want {
+			t.Errorf("got=%q, want=%q", got, want)
+		}
+	}()
+	s.MustDefine(1)
+}
+
+func TestSchemaMustDefineNotPositive(t *testing.T) {
+	var s Schema
+	defer func() {
+		if got, want := fmt.Sprint(recover()), "migration: version 0 is not positive"; got != want {
+			t.Errorf("got=%q, want=%q", got, want)
+		}
+	}()
+	s.MustDefine(0)
+}
+
+func TestSchemaPlan(t *testing.T) {
+	var s Schema
+	s.Define(1).Describe("create t1").Up(`create table t1(id int);`)
+	s.Define(2).Up(`create table t2(id int);`).Down(`drop table t2;`)
+	s.Define(3).
+		UpAction(TxFunc(func(ctx context.Context, tx *sql.Tx) error { return nil })).
+		Down(`delete from t2;`)
+	wantNoError(t, s.Err())
+
+	got := s.Plan()
+	want := []PlanItem{
+		{ID: 1, Description: "create t1", UpSQL: `create table t1(id int);`, DownSQL: `drop table t1;`, DownDerived: true},
+		{ID: 2, UpSQL: `create table t2(id int);`, DownSQL: `drop table t2;`},
+		{ID: 3, UpFunc: true, DownSQL: `delete from t2;`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%+v\nwant=%+v", got, want)
+	}
+}
+
+func TestSchemaDependsOn(t *testing.T) {
+	var s Schema
+	s.Define(1).Up(`create table t1(id int);`)
+	s.Define(2).Up(`create table t2(id int);`).DependsOn(4)
+	s.Define(3).Up(`create table t3(id int);`)
+	s.Define(4).Up(`create table t4(id int);`).DependsOn(1)
+	s.Define(5).Up(`create table t5(id int);`)
+	wantNoError(t, s.Err())
+
+	var ids []VersionID
+	for _, item := range s.Plan() {
+		ids = append(ids, item.ID)
+	}
+	if got, want := ids, []VersionID{1, 3, 4, 2, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestSchemaDump(t *testing.T) {
+	var s Schema
+	s.Define(1).Describe("create city").Up(`create table city(id int);`)
+	s.Define(2).Up(`create table country(id int);`).Down(`drop table country;`)
+	s.Define(3).
+		UpAction(TxFunc(func(ctx context.Context, tx *sql.Tx) error { return nil })).
+		Down(`delete from country;`)
+
+	var up strings.Builder
+	wantNoError(t, s.DumpUp(&up))
+	want := "-- Version 1: create city\n" +
+		"create table city(id int);\n" +
+		"\n" +
+		"-- Version 2\n" +
+		"create table country(id int);\n" +
+		"\n" +
+		"-- Version 3\n" +
+		"-- performed by a Go function (TxFunc)\n"
+	if got := up.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	var down strings.Builder
+	wantNoError(t, s.DumpDown(&down))
+	want = "-- Version 3\n" +
+		"delete from country;\n" +
+		"\n" +
+		"-- Version 2\n" +
+		"drop table country;\n" +
+		"\n" +
+		"-- Version 1: create city\n" +
+		"drop table city;\n"
+	if got := down.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	s.Define(4).Up(`insert into city(id) values(1);`)
+	wantError(t, s.DumpUp(&up), "down migration not defined")
+}
+
+func TestSchemaGenerateSquash(t *testing.T) {
+	var s Schema
+	s.Define(1).Describe("city").Up(`create table city(id int);`)
+	s.Define(2).Up(`create table country(code text);`)
+	s.Define(3).Up(`create index on city(id);`).Down(`drop index city_id_idx;`)
+	s.Define(4).UpAction(TxFunc(func(ctx context.Context, tx *sql.Tx) error {
+		return nil
+	})).Down(`select 1;`)
+
+	var sb strings.Builder
+	wantNoError(t, s.GenerateSquash(3, &sb))
+	want := `// Versions 1 to 3 squashed into a single migration.
+//
+// Replace the definitions of versions 1 to 3 with this definition.
+// New databases are migrated to version 3 in a single migration.
+// Databases that have already applied version 3 are not affected,
+// except that Worker.Up reports a checksum mismatch because the up
+// migration has changed. Before deploying, clear the checksum with:
+//  update schema_migrations set checksum = null where id = 3;
+// Schema.ValidateAgainst reports versions 1 to 2 as applied to those
+// databases but not defined in the schema.
+//
+// The down migration must be defined, because cannot reverse statement: create index on city(id).
+schema.Define(3).
+	Describe("versions 1 to 3 squashed").
+	Up(` + "`" + `
+-- Version 1: city
+create table city(id int);
+
+-- Version 2
+create table country(code text);
+
+-- Version 3
+create index on city(id);
+` + "`" + `)
+`
+	if got := sb.String(); got != want {
+		t.Errorf("got=%s\nwant=%s", got, want)
+	}
+
+	wantError(t, s.GenerateSquash(4, &sb), "cannot squash version 4: it is performed by a Go function")
+	wantError(t, s.GenerateSquash(5, &sb), "cannot squash: version 5 is not defined")
+
+	var deps Schema
+	deps.Define(1).Up(`create table t1(id int);`)
+	deps.Define(2).Up(`create table t2(id int);`).DependsOn(3)
+	deps.Define(3).Up(`create table t3(id int);`)
+	wantError(t, deps.GenerateSquash(2, &sb), "cannot squash version 2: it is applied after version 3")
+}
+
+func TestSchemaLint(t *testing.T) {
+	tests := []struct {
+		ids          []VersionID
+		descriptions map[VersionID]string
+		want         []string
+	}{
+		{
+			ids: []VersionID{1, 2, 3, 4},
+		},
+		{
+			ids: []VersionID{20240101120000, 20240105093000, 20240312170000},
+		},
+		{
+			ids: []VersionID{1, 2, 3, 5000},
+			want: []string{
+				"5000: gap of 4997 after version 3",
+			},
+		},
+		{
+			ids: []VersionID{1, 2, 3},
+			descriptions: map[VersionID]string{
+				2: "create city",
+				3: "Create City",
+			},
+			want: []string{
+				"3: same description as version 2: Create City",
+			},
+		},
+	}
+
+	for tn, tt := range tests {
+		var s Schema
+		for _, id := range tt.ids {
+			s.Define(id).Describe(tt.descriptions[id]).Up(fmt.Sprintf(`create table t%d(id int);`, id))
+		}
+		var got []string
+		for _, w := range s.Lint() {
+			got = append(got, w.String())
+		}
+		if want := tt.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d: got=%q, want=%q", tn, got, want)
+		}
+	}
+}
+
+func TestSchemaLazyDown(t *testing.T) {
+	ctx := context.Background()
+	db := openMemoryDB(t)
+
+	s := &Schema{LazyDown: true}
+	s.Define(1).Up(`create table t1(id int, name text);`)
+	s.Define(2).Up(`update t1 set name = 'x';`)
+	s.Define(3).Up(`alter table t1 add column code text;`)
+
+	// down migrations are not derived until needed
+	wantNoError(t, s.Err())
+	for _, p := range s.plans {
+		if p.down.sql != "" {
+			t.Errorf("%d: down migration derived early", p.id)
+		}
+	}
+
+	items := s.Plan()
+	if got, want := items[2].DownSQL, "alter table t1 drop column code;"; got != want {
+		t.Errorf("got=%q, want=%q", got, want)
+	}
+	if !items[2].DownDerived {
+		t.Error("want DownDerived")
+	}
+	wantError(t, s.DumpDown(&strings.Builder{}), "2: down migration not defined: cannot reverse statement: update t1 set name = 'x'")
+
+	worker, err := NewWorker(db, s)
+	wantNoError(t, err)
+	wantNoError(t, worker.Up(ctx))
+	wantNoError(t, worker.Goto(ctx, 2))
+	wantError(t, worker.Goto(ctx, 1), "2: down migration not defined: cannot reverse statement: update t1 set name = 'x'")
+	current, err := worker.CurrentVersion(ctx)
+	wantNoError(t, err)
+	if got, want := current, VersionID(2); got != want {
+		t.Errorf("got=%d, want=%d", got, want)
+	}
+
+	// the same schema reports the error immediately without LazyDown
+	s.LazyDown = false
+	s.plans = nil
+	wantError(t, s.Err(), "2: down migration not defined")
+}
+
+func BenchmarkSchemaErr(b *testing.B) {
+	for _, lazyDown := range []bool{false, true} {
+		b.Run(fmt.Sprintf("LazyDown=%v", lazyDown), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s := Schema{LazyDown: lazyDown}
+				for id := VersionID(1); id <= 500; id++ {
+					if id%2 == 0 {
+						s.Define(id).
+							Up(fmt.Sprintf(`create table t%d(id int primary key, name text);`, id)).
+							Down(fmt.Sprintf(`drop table t%d;`, id))
+					} else {
+						s.Define(id).Up(fmt.Sprintf(`
+							drop view if exists v1;
+							create view v1 as select %d as id;
+							comment on view v1 is 'version %d';
+						`, id, id))
+					}
+				}
+				if err := s.Err(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaValidateAgainst(t *testing.T) {
+	ctx := context.Background()
+	db := openMemoryDB(t)
+
+	newSchema := func(ids ...VersionID) *Schema {
+		var s Schema
+		for _, id := range ids {
+			s.Define(id).Up(fmt.Sprintf(`create table t%d(id int);`, id))
+		}
+		return &s
+	}
+
+	// no migrations table
+	wantNoError(t, newSchema(1).ValidateAgainst(ctx, db))
+
+	worker, err := NewWorker(db, newSchema(1, 2, 3, 4))
+	wantNoError(t, err)
+	wantNoError(t, worker.Up(ctx))
+
+	wantNoError(t, newSchema(1, 2, 3, 4, 5).ValidateAgainst(ctx, db))
+
+	err = newSchema(1, 2).ValidateAgainst(ctx, db)
+	if got, want := fmt.Sprint(err), "3: applied to database but not defined in schema\n4: applied to database but not defined in schema"; got != want {
+		t.Errorf("got=%q\nwant=%q", got, want)
+	}
+}
+
 func TestSchemaReplay(t *testing.T) {
 	tests := []struct {
 		fn   func(s *Schema) string
@@ -167,6 +571,157 @@ func TestSchemaReplay(t *testing.T) {
 			},
 			want: "create view v1;",
 		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create view v1 as select 1;")
+				s.Define(2).Up("drop view if exists v1; create view v1 as select 2;")
+				s.complete()
+				return s.plans[1].down.sql
+			},
+			want: "drop view v1;\ncreate view v1 as select 1;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create view v1 as select 1;")
+				s.Define(2).Up("drop view if exists v1; create view v1 as select 2;")
+				s.Define(3).Up("create table t1(id int);")
+				s.Define(4).Up("drop view if exists v1; create view v1 as select 4;")
+				s.complete()
+				return s.plans[3].down.sql
+			},
+			want: "drop view v1;\ncreate view v1 as select 2;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("drop view if exists v1; create view v1 as select 1;")
+				s.complete()
+				return s.plans[0].down.sql
+			},
+			want: "drop view v1;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create view v1 as select 1;")
+				s.Define(2).Up("drop view v1;").Down("create view v1 as select 1;")
+				s.Define(3).Up("drop view if exists v1; create view v1 as select 3;")
+				s.complete()
+				return s.plans[2].down.sql
+			},
+			want: "drop view v1;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create or replace view v1 as select 1;")
+				s.Define(2).Up("create or replace view v1 as select 1, 2;")
+				s.Define(3).Up("create or replace view v1 as select 1, 2, 3;")
+				s.complete()
+				return s.plans[2].down.sql + "\n" + s.plans[0].down.sql
+			},
+			want: "drop view v1;\ncreate or replace view v1 as select 1, 2;\ndrop view v1;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create view v1 as select 1;")
+				s.Define(2).Up("CREATE OR REPLACE VIEW V1 AS SELECT 2;")
+				s.complete()
+				return s.plans[1].down.sql
+			},
+			want: "drop view V1;\ncreate view v1 as select 1;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create view v1 as select 1;")
+				s.Define(2).Up("create table t1(id int);")
+				s.Define(3).Up("alter table t1 add column name text;")
+				s.Define(4).Up("drop view v1;")
+				s.complete()
+				return s.plans[3].down.sql
+			},
+			want: "create view v1 as select 1;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create materialized view mv1 as select 1;")
+				s.Define(2).Up("drop materialized view if exists mv1; create materialized view mv1 as select 2;")
+				s.complete()
+				return s.plans[1].down.sql
+			},
+			want: "drop materialized view mv1;\ncreate materialized view mv1 as select 1;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create view mv1 as select 1;")
+				s.Define(2).Up("drop materialized view if exists mv1; create materialized view mv1 as select 2;")
+				s.complete()
+				return s.plans[1].down.sql
+			},
+			want: "drop materialized view mv1;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create trigger trg1 before insert on t1 for each row execute function f1();")
+				s.Define(2).Up("drop trigger if exists trg1 on t1; create trigger trg1 after insert on t1 for each row execute function f2();")
+				s.complete()
+				return s.plans[1].down.sql
+			},
+			want: "drop trigger trg1 on t1;\ncreate trigger trg1 before insert on t1 for each row execute function f1();",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create trigger trg1 before insert on t1 for each row execute function f1();")
+				s.Define(2).Up("create or replace trigger trg1 after insert on t1 for each row execute function f2();")
+				s.complete()
+				return s.plans[1].down.sql
+			},
+			want: "drop trigger trg1 on t1;\ncreate trigger trg1 before insert on t1 for each row execute function f1();",
+		},
+		{
+			fn: func(s *Schema) string {
+				// a trigger with the same name on a different table
+				s.Define(1).Up("create trigger trg1 before insert on t1 for each row execute function f1();")
+				s.Define(2).Up("drop trigger if exists trg1 on t2; create trigger trg1 before insert on t2 for each row execute function f2();")
+				s.complete()
+				return s.plans[1].down.sql
+			},
+			want: "drop trigger trg1 on t2;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create trigger trg1 before insert on t1 for each row execute function f1();")
+				s.Define(2).Up("drop trigger trg1 on t1;").Down("create trigger trg1 before insert on t1 for each row execute function f1();")
+				s.Define(3).Up("drop trigger if exists trg1 on t1; create trigger trg1 before insert on t1 for each row execute function f3();")
+				s.complete()
+				return s.plans[2].down.sql
+			},
+			want: "drop trigger trg1 on t1;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create function f1() returns int as $$ begin return 1; end; $$ language plpgsql;")
+				s.Define(2).Up("create or replace function f1() returns int as $$ begin return 2; end; $$ language plpgsql;")
+				s.complete()
+				return s.plans[1].down.sql
+			},
+			want: "drop function f1;\ncreate function f1() returns int as $$ begin return 1; end; $$ language plpgsql;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create or replace function f1() returns int as $$ begin return 1; end; $$ language plpgsql;")
+				s.Define(2).Up("create table t1(id int);")
+				s.Define(3).Up("drop function if exists f1; create function f1() returns int as $$ begin return 3; end; $$ language plpgsql;")
+				s.complete()
+				return s.plans[2].down.sql
+			},
+			want: "drop function f1;\ncreate or replace function f1() returns int as $$ begin return 1; end; $$ language plpgsql;",
+		},
+		{
+			fn: func(s *Schema) string {
+				s.Define(1).Up("create or replace procedure p1() language sql as $$ delete from t1; $$;")
+				s.complete()
+				return s.plans[0].down.sql
+			},
+			want: "drop procedure p1;",
+		},
 	}
 	for tn, tt := range tests {
 		var s Schema
@@ -5,7 +5,9 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"os"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -19,15 +21,303 @@ type Worker struct {
 	// One common practice is to assign the log.Println function to LogFunc.
 	LogFunc func(v ...interface{})
 
-	schema     *Schema
-	db         *sql.DB
-	drv        driver
-	initCalled bool
+	// Logger is a structured logger for logging progress. If both Logger
+	// and LogFunc are specified, Logger is used.
+	Logger Logger
+
+	// LogKeyvals, if specified, is called for each message logged using
+	// Logger or LogFunc, and returns alternating key/value pairs that are
+	// logged before the key/value pairs of the message, for example to
+	// include a deployment ID in every message. The id parameter is the
+	// version that the message refers to, or zero if there is none.
+	LogKeyvals func(id VersionID) []interface{}
+
+	// LockTimeout specifies how long to wait to acquire the migration lock
+	// before reporting an error. The lock prevents migrations from being
+	// performed concurrently by multiple processes, and is only supported
+	// by some drivers (currently Postgres and MySQL). If not specified,
+	// the worker waits indefinitely.
+	LockTimeout time.Duration
+
+	// WarnChecksumMismatch, if set, causes Up to log a warning instead
+	// of failing when the up migration for a previously applied version
+	// has changed since it was applied.
+	WarnChecksumMismatch bool
+
+	// BeforeEach, if specified, is called before each up or down migration
+	// is performed. If it returns an error, the migration is not performed
+	// and the error is returned. It is called outside of any transaction.
+	BeforeEach func(ctx context.Context, ver *Version, dir Direction) error
+
+	// AfterEach, if specified, is called after each up or down migration
+	// is attempted, along with the error from the migration, if any. It is
+	// called outside of any transaction, so it observes the committed state
+	// of the database.
+	AfterEach func(ctx context.Context, ver *Version, dir Direction, err error)
+
+	// OnFailure, if specified, is called when a migration performed outside
+	// of a transaction fails. The version has been recorded as failed, and
+	// the database requires manual repair (see Force). It is called before
+	// the error is returned, and is intended for alerting.
+	OnFailure func(ctx context.Context, id VersionID, dir Direction, err error)
+
+	// Retry specifies how migrations performed in a transaction are retried
+	// after a transient error. If not specified, no migrations are retried.
+	Retry RetryPolicy
+
+	// Progress, if specified, is called before each up or down migration
+	// is performed by Up, Down, Goto, UpTo, DownTo, Reset and Steps. The
+	// done parameter is the number of migrations already performed, and
+	// total is the number of migrations planned when the call started.
+	// It is called outside of any transaction, after BeforeEach.
+	Progress func(done, total int, ver *Version)
+
+	// DryRun, if set, causes Up, UpResult, UpTo, UpWithLeaderElection, Down,
+	// DownResult, DownTo, Goto, GotoResult, GotoDelta and Steps to log the
+	// migrations that would be performed without performing them, and
+	// causes Reset to return an error. SQL migrations are executed in a
+	// transaction that is rolled back, so that errors are reported, unless
+	// the database does not support transactional DDL, in which case they
+	// are only logged. No DBFunc or TxFunc actions are called. The migration
+	// lock is not acquired, and the migrations table is neither created nor
+	// modified.
+	DryRun bool
+
+	// AllInOneTransaction, if set, causes Up to perform all pending up
+	// migrations in a single transaction, so that if any migration fails,
+	// none of them are applied. This requires a database that supports
+	// transactional DDL, and none of the pending migrations can be
+	// performed outside of a transaction (see Definition.NoTx). If these
+	// conditions are not met, Up reports an error without performing any
+	// migrations. The BeforeEach and AfterEach hooks are not called, because
+	// the migrations are not committed individually.
+	AllInOneTransaction bool
+
+	// StatementTimeout, if specified, limits the time taken to execute
+	// the SQL for each migration. If the SQL does not complete in time,
+	// it is cancelled and the migration fails with an error. Only the
+	// SQL for the migration is cancelled, not the entire operation.
+	// If the SQL is split into statements, the timeout applies to each
+	// statement. If zero, there is no timeout.
+	StatementTimeout time.Duration
+
+	// TxOptions, if specified, are the options for the transactions in
+	// which migrations are performed, for example to perform migrations
+	// with serializable isolation. If not specified, the default options
+	// for the database driver are used. Transactions that only read or
+	// update the migrations table use the default options.
+	//
+	// The Postgres and MySQL database drivers support the isolation
+	// levels and read-only transactions of their respective databases,
+	// and report an error for an unsupported isolation level. The SQLite
+	// database driver ignores the options.
+	TxOptions *sql.TxOptions
+
+	// SplitStatements, if set, causes the SQL for each migration to be
+	// split into individual statements, which are executed one at a time.
+	// This is necessary for database drivers that cannot execute multiple
+	// statements in a single call, such as the MySQL driver when the DSN
+	// does not specify multiStatements=true. Statements are split
+	// automatically if the migration driver reports that it does not
+	// support multiple statements. See MultiStatementDriver. SQL that
+	// contains a compound statement, such as a trigger body delimited by
+	// BEGIN and END, or a MySQL conditional comment, is not split, and is
+	// executed in a single call.
+	SplitStatements bool
+
+	// Now, if specified, is called to obtain the current time. It is used
+	// to record the time each version is applied, and the time taken to
+	// perform each migration. If not specified, time.Now is used.
+	Now func() time.Time
+
+	// AppliedBy identifies the application or host performing migrations.
+	// It is recorded with each version that is applied, for auditing. If
+	// not specified, the host name is used.
+	AppliedBy string
+
+	schema          *Schema
+	migrationsTable string           // overrides schema.MigrationsTable if not empty
+	searchPath      string           // schema for search path, if not empty
+	databaseClock   bool             // record applied time using the database clock
+	skipCreateTable bool             // migrations table must already exist
+	storedSQL       bool             // store up and down migrations in the migrations table
+	versionFuncs    versionFuncs     // custom access to the migrations table
+	plans           []*migrationPlan // schema plans, in ascending order
+	planMap         map[VersionID]*migrationPlan
+	db              *sql.DB
+	drv             Driver
+	initCalled      bool
+	detected        bool      // has detectDriver queried the database
+	noTable         bool      // dry run, and the migrations table does not exist
+	progress        *progress // migrations performed, for the Progress hook
+	createTableSQL  func(tableName string) string
+}
+
+// An Option configures a worker created by NewWorker.
+type Option func(*Worker)
+
+// WithMigrationsTable specifies the name of the migrations table used by
+// the worker. This is useful when the same schema is used to migrate
+// several databases that each need a different migrations table.
+//
+// The migrations table name is determined in order of precedence by
+// WithMigrationsTable, then Schema.MigrationsTable, then the constant
+// DefaultMigrationsTable. The Schema.Name suffix is not appended to a
+// name specified by WithMigrationsTable.
+func WithMigrationsTable(name string) Option {
+	return func(m *Worker) {
+		m.migrationsTable = name
+	}
+}
+
+// WithSearchPath specifies a schema that is set as the search path for
+// each transaction performed by the worker, and that qualifies the
+// migrations table name if it does not already include a schema. This
+// is useful for running the same migrations into a separate PostgreSQL
+// schema for each tenant.
+//
+// The search path is set using SET LOCAL, so it does not persist after
+// the transaction ends, and does not affect other users of pooled
+// connections. Because of this, the search path does not apply to
+// migrations that are performed outside of a transaction, which should
+// use fully qualified names.
+//
+// WithSearchPath only has an effect if the database driver implements
+// SearchPathDriver, which currently means PostgreSQL. For other databases
+// it is ignored.
+func WithSearchPath(schema string) Option {
+	return func(m *Worker) {
+		m.searchPath = schema
+	}
+}
+
+// WithCreateTableSQL specifies a function that returns the SQL used to
+// create the migrations table, instead of the SQL provided by the database
+// driver. This is useful when the table requires a tablespace, storage
+// parameters or a specific owner. The function is passed the migrations
+// table name, and the SQL it returns must quote the name if necessary.
+//
+// The SQL is only executed if the migrations table does not exist. The
+// table must have the columns id, applied_at, failed, locked, duration_ms,
+// description, checksum, failed_statement and applied_by, with types
+// compatible with the table created by the driver. The worker checks that
+// the columns exist before performing any migrations, but unlike the
+// driver, it does not add missing columns to an existing table.
+func WithCreateTableSQL(fn func(tableName string) string) Option {
+	return func(m *Worker) {
+		m.createTableSQL = fn
+	}
+}
+
+// WithSkipCreateTable specifies that the worker does not create the
+// migrations table, which must already exist. This supports deployments
+// where the database user performing migrations does not have privileges
+// to create tables, and the migrations table is created in advance by a
+// database administrator. The table must have the same columns as the
+// table created by the database driver (see WithCreateTableSQL). The
+// worker checks that the table exists and has the expected columns
+// before performing any migrations, and reports an error if it does not.
+func WithSkipCreateTable() Option {
+	return func(m *Worker) {
+		m.skipCreateTable = true
+	}
+}
+
+// WithDatabaseClock specifies that the time each version is applied is
+// recorded using the database clock instead of the Now function, which
+// avoids inconsistent times when the clocks of the hosts performing the
+// migrations differ from the database clock. The time taken to perform
+// each migration is still measured using the Now function.
+//
+// WithDatabaseClock only has an effect if the database driver implements
+// DatabaseClockDriver, which the built-in drivers do. For other databases
+// it is ignored.
+func WithDatabaseClock() Option {
+	return func(m *Worker) {
+		m.databaseClock = true
+	}
+}
+
+// WithStoredSQL specifies that the up and down migrations of each version
+// are stored in the migrations table when the version is applied, so that
+// the database records what was applied, for auditing. Migrations performed
+// by Go functions are stored as "(DBFunc)" or "(TxFunc)". The migrations are
+// stored in the up_sql and down_sql columns, which are added to the table if
+// they do not exist, unless WithSkipCreateTable is specified. For applied
+// versions, Version.Up and Version.Down report the stored migrations, if any.
+//
+// WithStoredSQL requires a database driver that implements StoredSQLDriver,
+// which the built-in drivers do.
+func WithStoredSQL() Option {
+	return func(m *Worker) {
+		m.storedSQL = true
+	}
+}
+
+// versionFuncs are the functions specified by WithListVersionsFunc,
+// WithInsertVersionFunc, WithUpdateVersionFunc and WithDeleteVersionFunc.
+type versionFuncs struct {
+	list   func(ctx context.Context, tx *sql.Tx, table string) ([]*Version, error)
+	insert func(ctx context.Context, tx *sql.Tx, table string, ver *Version) error
+	update func(ctx context.Context, tx *sql.Tx, table string, ver *Version) error
+	delete func(ctx context.Context, tx *sql.Tx, table string, id VersionID) error
+}
+
+// custom reports whether any of the functions has been specified.
+func (f *versionFuncs) custom() bool {
+	return f.list != nil || f.insert != nil || f.update != nil || f.delete != nil
+}
+
+// WithListVersionsFunc specifies a function that reads the rows of the
+// migrations table, instead of the database driver. Together with
+// WithInsertVersionFunc, WithUpdateVersionFunc and WithDeleteVersionFunc,
+// it allows the worker to use an existing migrations table with a different
+// layout, such as a table created by another migration tool, without
+// renaming its columns. The function is passed the migrations table name,
+// and returns the versions in ascending order of version.
+//
+// All four functions should be specified together, so that the worker
+// reads the rows that it writes. If any of them are specified, the worker
+// does not create the migrations table, which must already exist, and it
+// does not record the applied time using the database clock, or the failed
+// statement of a migration performed outside of a transaction. They cannot
+// be used with WithStoredSQL.
+func WithListVersionsFunc(fn func(ctx context.Context, tx *sql.Tx, table string) ([]*Version, error)) Option {
+	return func(m *Worker) {
+		m.versionFuncs.list = fn
+	}
+}
+
+// WithInsertVersionFunc specifies a function that inserts a row into the
+// migrations table, instead of the database driver. See WithListVersionsFunc.
+func WithInsertVersionFunc(fn func(ctx context.Context, tx *sql.Tx, table string, ver *Version) error) Option {
+	return func(m *Worker) {
+		m.versionFuncs.insert = fn
+	}
+}
+
+// WithUpdateVersionFunc specifies a function that updates a row in the
+// migrations table, instead of the database driver. It is called when the
+// Failed, Locked or Duration field of an applied version changes, and is
+// passed the version with the changed field. See WithListVersionsFunc.
+func WithUpdateVersionFunc(fn func(ctx context.Context, tx *sql.Tx, table string, ver *Version) error) Option {
+	return func(m *Worker) {
+		m.versionFuncs.update = fn
+	}
+}
+
+// WithDeleteVersionFunc specifies a function that deletes a row from the
+// migrations table, instead of the database driver. See WithListVersionsFunc.
+func WithDeleteVersionFunc(fn func(ctx context.Context, tx *sql.Tx, table string, id VersionID) error) Option {
+	return func(m *Worker) {
+		m.versionFuncs.delete = fn
+	}
 }
 
 // NewWorker creates a worker that can perform migrations for
 // the specified database using the database migration schema.
-func NewWorker(db *sql.DB, schema *Schema) (*Worker, error) {
+// The schema must not be modified after the worker is created.
+func NewWorker(db *sql.DB, schema *Schema, opts ...Option) (*Worker, error) {
 	if err := schema.Err(); err != nil {
 		return nil, err
 	}
@@ -35,49 +325,196 @@ func NewWorker(db *sql.DB, schema *Schema) (*Worker, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newWorker(db, drv, schema, opts)
+}
+
+// NewWorkerWithDriver creates a worker that can perform migrations for
+// the specified database using the migration driver drv, instead of
+// the driver that NewWorker finds for the database. This is useful for
+// a database whose database/sql driver is not recognized, for example
+// because it wraps another driver to add tracing, and for testing with
+// a fake driver such as MemoryDriver. The schema must not be modified
+// after the worker is created.
+func NewWorkerWithDriver(db *sql.DB, drv Driver, schema *Schema, opts ...Option) (*Worker, error) {
+	if drv == nil {
+		return nil, errors.New("migration driver is nil")
+	}
+	if err := schema.Err(); err != nil {
+		return nil, err
+	}
+	return newWorker(db, drv, schema, opts)
+}
+
+// newWorker creates a worker that uses the migration driver drv.
+// The schema has already been checked for errors.
+func newWorker(db *sql.DB, drv Driver, schema *Schema, opts []Option) (*Worker, error) {
 	cmd := &Worker{
-		schema: schema,
-		db:     db,
-		drv:    drv,
+		schema:  schema,
+		plans:   schema.plans,
+		planMap: make(map[VersionID]*migrationPlan, len(schema.plans)),
+		db:      db,
+		drv:     drv,
+	}
+	for _, p := range schema.plans {
+		cmd.planMap[p.id] = p
+	}
+	for _, opt := range opts {
+		opt(cmd)
+	}
+	if cmd.searchPath != "" {
+		if err := checkSchemaName(cmd.searchPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkTableName(cmd.tableName()); err != nil {
+		return nil, err
 	}
 	return cmd, nil
 }
 
 // Up migrates the database to the latest version.
+//
+// If ctx is cancelled while a migration is performed in a transaction,
+// the transaction is rolled back, the migration lock is released, and
+// Up returns the context error wrapped with the version being migrated.
 func (m *Worker) Up(ctx context.Context) error {
-	if err := m.init(ctx); err != nil {
-		return err
-	}
-	for {
-		more, err := m.upOne(ctx)
+	_, err := m.UpResult(ctx)
+	return err
+}
+
+// UpResult migrates the database to the latest version, and
+// reports the versions that were applied.
+func (m *Worker) UpResult(ctx context.Context) (*Result, error) {
+	return m.migrate(ctx, func(r *Result) error {
+		if err := m.verifyChecksums(ctx); err != nil {
+			return err
+		}
+		if m.DryRun {
+			return m.dryRun(ctx, m.latestVersion(), false)
+		}
+		err := m.startProgress(ctx, func(vs *versionSummary) int {
+			return len(vs.unapplied)
+		})
 		if err != nil {
 			return err
 		}
-		if !more {
+		if m.AllInOneTransaction {
+			if err := m.upInOneTx(ctx, r); err != nil {
+				return err
+			}
 			m.finished(ctx, "migrate up finished")
-			break
+			return nil
+		}
+		for {
+			id, more, err := m.upOne(ctx, nil)
+			r.add(id, true)
+			if err != nil {
+				return err
+			}
+			if !more {
+				m.finished(ctx, "migrate up finished")
+				break
+			}
 		}
+		return nil
+	})
+}
+
+// UpWithLeaderElection migrates the database to the latest version, in a
+// way that suits many replicas of a program that migrate the database when
+// they start.
+//
+// Up acquires a lock before performing migrations (see LockTimeout), so one
+// replica performs the migrations while the others wait for the lock, and
+// then find that there is nothing to do. UpWithLeaderElection first checks,
+// without acquiring the lock or modifying the database, whether there are
+// any pending migrations. If there are none, it returns without acquiring
+// the lock, so replicas started after the database has been migrated do
+// not contend for the lock, and only need read access to the database.
+// Otherwise it calls Up. This also suits a single program that migrates
+// the database every time it starts: if the database is already at the
+// latest version, it performs a single read-only transaction.
+//
+// For databases that do not support locking, such as SQLite, replicas are
+// not prevented from performing migrations concurrently, in the same way
+// as Up.
+func (m *Worker) UpWithLeaderElection(ctx context.Context) error {
+	if m.DryRun {
+		return m.Up(ctx)
 	}
-	return nil
+	needed, mismatches, err := m.needsUp(ctx)
+	if err != nil {
+		return err
+	}
+	if needed {
+		return m.Up(ctx)
+	}
+	return m.checksumError(mismatches)
+}
+
+// needsUp reports whether Up needs to acquire the lock, because there are
+// pending or failed versions, or because the migrations table does not
+// exist. It also reports the applied versions whose checksums do not
+// match. It does not modify the database.
+func (m *Worker) needsUp(ctx context.Context) (needed bool, mismatches []VersionID, err error) {
+	if err := m.detectDriver(ctx); err != nil {
+		return false, nil, err
+	}
+	exists, err := m.drv.MigrationsTableExists(ctx, m.db, m.tableName())
+	if err != nil || !exists {
+		return !exists, nil, err
+	}
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		mismatches = vs.checksumMismatches()
+		needed = len(vs.unapplied) > 0
+		for _, ver := range vs.versions {
+			if ver.Failed {
+				// Up reports the error
+				needed = true
+			}
+		}
+		return nil
+	})
+	return needed, mismatches, err
 }
 
 // Down migrates the database down to the latest locked version.
 // If there are no locked versions, all down migrations are performed.
 func (m *Worker) Down(ctx context.Context) error {
-	if err := m.init(ctx); err != nil {
-		return err
-	}
-	for {
-		more, err := m.downOne(ctx)
+	_, err := m.DownResult(ctx)
+	return err
+}
+
+// DownResult migrates the database down to the latest locked version,
+// and reports the versions that were reverted.
+func (m *Worker) DownResult(ctx context.Context) (*Result, error) {
+	return m.migrate(ctx, func(r *Result) error {
+		if m.DryRun {
+			return m.dryRun(ctx, 0, true)
+		}
+		err := m.startProgress(ctx, func(vs *versionSummary) int {
+			return vs.countDown(0)
+		})
 		if err != nil {
 			return err
 		}
-		if !more {
-			m.finished(ctx, "migrate down finished")
-			break
+		for {
+			id, more, err := m.downOne(ctx, nil)
+			r.add(id, false)
+			if err != nil {
+				return err
+			}
+			if !more {
+				m.finished(ctx, "migrate down finished")
+				break
+			}
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
 // Version returns details of the specified version.
@@ -112,8 +549,16 @@ func (m *Worker) Version(ctx context.Context, id VersionID) (*Version, error) {
 // Force the database schema to a specific version.
 //
 // This is used to manually fix a database after a non-transactional
-// migration has failed.
+// migration has failed. The FailedStatement field of the failed version
+// identifies the statement that failed: the statements before it have
+// been applied, and the statements after it have not. See also Recover.
 func (m *Worker) Force(ctx context.Context, id VersionID) error {
+	return m.withLock(ctx, func() error {
+		return m.force(ctx, id)
+	})
+}
+
+func (m *Worker) force(ctx context.Context, id VersionID) error {
 	var err error
 
 	// a version id of zero is permitted for force
@@ -152,15 +597,15 @@ func (m *Worker) Force(ctx context.Context, id VersionID) error {
 		for _, plan := range vs.applied {
 			ver := vs.vmap[plan.id]
 			if ver.ID > id {
-				if err = m.drv.DeleteVersion(ctx, tx, m.tableName(), ver.ID); err != nil {
+				if err = m.deleteVersion(ctx, tx, ver.ID); err != nil {
 					return err
 				}
-				m.log(fmt.Sprintf("deleted database schema version id=%d", ver.ID))
+				m.info("deleted database schema version", "id", ver.ID)
 			} else if ver.Failed {
-				if err = m.drv.SetVersionFailed(ctx, tx, m.tableName(), ver.ID, false); err != nil {
+				if err = m.setVersionFailed(ctx, tx, ver.ID, false); err != nil {
 					return err
 				}
-				m.log(fmt.Sprintf("cleared database schema version failure id=%d", id))
+				m.info("cleared database schema version failure", "id", ver.ID)
 			}
 		}
 
@@ -175,6 +620,111 @@ func (m *Worker) Force(ctx context.Context, id VersionID) error {
 	return nil
 }
 
+// Recover records the outcome of a failed migration, after the database
+// has been repaired manually. If outcome is MarkApplied, the version is
+// recorded as successfully applied. If outcome is MarkRolledBack, the
+// version is recorded as not applied.
+//
+// Unlike Force, which infers what to do with each version from its
+// position relative to the forced version, Recover only changes the
+// failed version, and records the decision made by the operator.
+// It returns an error if the version has not failed.
+func (m *Worker) Recover(ctx context.Context, id VersionID, outcome Outcome) error {
+	if outcome != MarkApplied && outcome != MarkRolledBack {
+		return fmt.Errorf("invalid outcome: %v", outcome)
+	}
+	return m.withLock(ctx, func() error {
+		return m.recover(ctx, id, outcome)
+	})
+}
+
+func (m *Worker) recover(ctx context.Context, id VersionID, outcome Outcome) error {
+	if err := m.init(ctx); err != nil {
+		return err
+	}
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		ver := vs.vmap[id]
+		if ver == nil || ver.AppliedAt == nil || !ver.Failed {
+			return fmt.Errorf("cannot recover version %d: migration has not failed", id)
+		}
+		if outcome == MarkApplied {
+			return m.setVersionFailed(ctx, tx, id, false)
+		}
+		return m.deleteVersion(ctx, tx, id)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.info("recovered failed migration", "version", id, "outcome", outcome)
+	m.finished(ctx, "recover finished")
+
+	return nil
+}
+
+// Baseline records all versions up to and including id as applied,
+// without performing their migrations.
+//
+// This is used when adopting migrations for an existing database, whose
+// schema has already been created by other means. After the database
+// has been baselined, later versions are migrated as usual. It is an
+// error if any of the versions have already been applied.
+func (m *Worker) Baseline(ctx context.Context, id VersionID) error {
+	return m.withLock(ctx, func() error {
+		return m.baseline(ctx, id)
+	})
+}
+
+func (m *Worker) baseline(ctx context.Context, id VersionID) error {
+	var err error
+	if err = m.checkVersion(id); err != nil {
+		return err
+	}
+	if err = m.init(ctx); err != nil {
+		return err
+	}
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, plan := range vs.applied {
+			if plan.id <= id {
+				return fmt.Errorf("cannot baseline: version %d already applied", plan.id)
+			}
+		}
+		now := m.now()
+		for _, plan := range vs.unapplied {
+			if plan.id > id {
+				break
+			}
+			ver := &Version{
+				ID:          plan.id,
+				Description: plan.description,
+				AppliedAt:   &now,
+				Checksum:    plan.checksum,
+				AppliedBy:   m.appliedBy(),
+			}
+			if err = m.insertVersion(ctx, tx, ver); err != nil {
+				return err
+			}
+			m.info("baselined database schema version", "id", plan.id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.finished(ctx, "database schema baselined")
+
+	return nil
+}
+
 // Lock a database schema version.
 //
 // This is used to prevent accidental down migrations. When a database
@@ -215,13 +765,13 @@ func (m *Worker) lockHelper(ctx context.Context, id VersionID, verb string, lock
 			return fmt.Errorf("cannot %s unapplied version id=%d", verb, id)
 		}
 
-		return m.drv.SetVersionLocked(ctx, tx, m.tableName(), id, lock)
+		return m.setVersionLocked(ctx, tx, id, lock)
 	})
 	if err != nil {
 		return err
 	}
 
-	m.log(fmt.Sprintf("%s version=%d", verb, id))
+	m.info(verb, "version", id)
 
 	return nil
 }
@@ -230,97 +780,783 @@ func (m *Worker) lockHelper(ctx context.Context, id VersionID, verb string, lock
 //
 // If id is zero, then all down migrations are applied
 // to result in an empty database.
+//
+// If versions are ordered by Definition.DependsOn, Goto stops
+// at the first version in that order with an id greater than id.
 func (m *Worker) Goto(ctx context.Context, id VersionID) error {
+	_, err := m.GotoResult(ctx, id)
+	return err
+}
+
+// GotoResult migrates up or down to the specified version, and
+// reports the versions that were applied and reverted.
+func (m *Worker) GotoResult(ctx context.Context, id VersionID) (*Result, error) {
 	// id=0 is a special case, remove all migrations
 	if id != 0 {
 		if err := m.checkVersion(id); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	if err := m.init(ctx); err != nil {
-		return err
-	}
-	for {
-		more, err := m.gotoOne(ctx, id)
-		if err != nil {
-			return err
+	return m.migrate(ctx, func(r *Result) error {
+		if m.DryRun {
+			return m.dryRun(ctx, id, false)
 		}
-		if !more {
-			m.finished(ctx, "migrate goto finished")
-			break
+		if err := m.gotoVersion(ctx, id, r, true, true); err != nil {
+			return err
 		}
-	}
-	return nil
+		m.finished(ctx, "migrate goto finished")
+		return nil
+	})
 }
 
-// Versions lists all of the database schema versions.
-func (m *Worker) Versions(ctx context.Context) ([]*Version, error) {
-	var versions []*Version
-	if err := m.init(ctx); err != nil {
-		return versions, err
-	}
-	err := m.transact(ctx, func(tx *sql.Tx) error {
-		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
-		if err != nil {
+// GotoDelta migrates up or down by delta versions from the current
+// version, in the order the versions are applied. For example, a delta
+// of -1 migrates down to the previous version, and a delta of 3 migrates
+// up to the version three after the current version. It is an error if
+// delta would move before version zero or past the latest version.
+// Locked versions are handled in the same way as Goto.
+func (m *Worker) GotoDelta(ctx context.Context, delta int) error {
+	_, err := m.migrate(ctx, func(r *Result) error {
+		index := -1 // version zero
+		if r.StartVersion != 0 {
+			index = m.planIndex(r.StartVersion)
+			if index < 0 {
+				return fmt.Errorf("current version %d is not defined in the schema", r.StartVersion)
+			}
+		}
+		index += delta
+		if index < -1 || index >= len(m.plans) {
+			return fmt.Errorf("cannot migrate %+d versions from version %d: there are %d versions before it and %d after it",
+				delta, r.StartVersion, index-delta+1, len(m.plans)-(index-delta)-1)
+		}
+		var id VersionID
+		if index >= 0 {
+			id = m.plans[index].id
+		}
+		if m.DryRun {
+			return m.dryRun(ctx, id, false)
+		}
+		if err := m.gotoVersion(ctx, id, r, true, true); err != nil {
 			return err
 		}
-		versions = vs.versions
-
+		m.finished(ctx, "migrate goto finished")
 		return nil
 	})
-	return versions, err
+	return err
 }
 
-func (m *Worker) init(ctx context.Context) error {
-	if m.initCalled {
-		return nil
+// planIndex returns the index of version id in the plans,
+// or -1 if it is not defined.
+func (m *Worker) planIndex(id VersionID) int {
+	for i, plan := range m.plans {
+		if plan.id == id {
+			return i
+		}
 	}
-	err := m.drv.CreateMigrationsTable(ctx, m.db, m.tableName())
-	if err != nil {
+	return -1
+}
+
+// UpTo migrates the database up to version id. Unlike Goto, it never
+// performs down migrations: it is an error if the current version is
+// later than id.
+func (m *Worker) UpTo(ctx context.Context, id VersionID) error {
+	if err := m.checkVersion(id); err != nil {
 		return err
 	}
-	m.initCalled = true
-	return nil
+	_, err := m.migrate(ctx, func(r *Result) error {
+		if r.StartVersion > id {
+			return fmt.Errorf("cannot migrate up to version %d: current version is %d", id, r.StartVersion)
+		}
+		if m.DryRun {
+			return m.dryRun(ctx, id, false)
+		}
+		if err := m.gotoVersion(ctx, id, r, true, false); err != nil {
+			return err
+		}
+		m.finished(ctx, "migrate up finished")
+		return nil
+	})
+	return err
 }
 
-func (m *Worker) log(args ...interface{}) {
-	if m.LogFunc != nil {
-		m.LogFunc(args...)
+// DownTo migrates the database down to version id. Unlike Goto, it never
+// performs up migrations: it is an error if the current version is earlier
+// than id. Any unapplied versions earlier than id remain unapplied.
+func (m *Worker) DownTo(ctx context.Context, id VersionID) error {
+	// id=0 is a special case, remove all migrations
+	if id != 0 {
+		if err := m.checkVersion(id); err != nil {
+			return err
+		}
 	}
+	_, err := m.migrate(ctx, func(r *Result) error {
+		if r.StartVersion < id {
+			return fmt.Errorf("cannot migrate down to version %d: current version is %d", id, r.StartVersion)
+		}
+		if m.DryRun {
+			return m.dryRun(ctx, id, false)
+		}
+		if err := m.gotoVersion(ctx, id, r, false, true); err != nil {
+			return err
+		}
+		m.finished(ctx, "migrate down finished")
+		return nil
+	})
+	return err
 }
 
-func (m *Worker) finished(ctx context.Context, msg string) error {
-	return m.transact(ctx, func(tx *sql.Tx) error {
-		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+// Reset migrates the database all the way down, and then all the way
+// up again. This is useful for rebuilding a database from scratch in
+// integration tests. If any version is locked, no migrations are
+// performed and an error is returned.
+func (m *Worker) Reset(ctx context.Context) error {
+	if m.DryRun {
+		return errors.New("reset is not supported for a dry run")
+	}
+	_, err := m.migrate(ctx, func(r *Result) error {
+		err := m.startProgress(ctx, func(vs *versionSummary) int {
+			return len(vs.applied) + len(m.plans)
+		})
 		if err != nil {
 			return err
 		}
-		args := []interface{}{msg}
-		if len(vs.applied) > 0 {
-			plan := vs.applied[0]
-			version := vs.vmap[plan.id]
-			args = append(args, fmt.Sprintf("version=%d", version.ID))
-			if version.Locked {
-				args = append(args, "status=locked")
+		if err := m.gotoVersion(ctx, 0, r, true, true); err != nil {
+			return err
+		}
+		for {
+			id, more, err := m.upOne(ctx, nil)
+			r.add(id, true)
+			if err != nil {
+				return err
 			}
-			if version.Failed {
-				args = append(args, "status=failed")
+			if !more {
+				break
 			}
-		} else {
-			args = append(args, "version=0")
 		}
-		m.log(args...)
+		m.finished(ctx, "reset finished")
 		return nil
 	})
+	return err
 }
 
-func (m *Worker) transact(ctx context.Context, fn func(tx *sql.Tx) error) error {
-	tx, err := m.db.BeginTx(ctx, nil)
-	if err != nil {
-		return wrapf(err, "cannot begin tx")
+// Steps migrates up or down by a fixed number of versions. If n is
+// positive, up to n up migrations are applied. If n is negative, up to
+// |n| down migrations are applied.
+//
+// Fewer migrations are performed if there are no more to apply, or if
+// a down migration would pass a locked version. Steps returns the number
+// of migrations actually performed, or that would be performed if DryRun
+// is set.
+func (m *Worker) Steps(ctx context.Context, n int) (int, error) {
+	var count int
+	if m.DryRun {
+		_, err := m.migrateDryRun(ctx, func(r *Result) error {
+			var err error
+			count, err = m.dryRunSteps(ctx, n)
+			return err
+		})
+		return count, err
 	}
-
-	if err = fn(tx); err != nil {
+	err := m.withLock(ctx, func() error {
+		var err error
+		count, err = m.steps(ctx, n)
+		m.progress = nil
+		return err
+	})
+	return count, err
+}
+
+func (m *Worker) steps(ctx context.Context, n int) (int, error) {
+	if err := m.init(ctx); err != nil {
+		return 0, err
+	}
+	var count int
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+		count = vs.countSteps(n)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	m.progress = &progress{total: count}
+	for i := 0; i < count; i++ {
+		if n > 0 {
+			_, _, err = m.upOne(ctx, nil)
+		} else {
+			_, _, err = m.downOne(ctx, nil)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	m.finished(ctx, "migrate steps finished")
+	return count, nil
+}
+
+// CurrentVersion returns the most recently applied database schema
+// version, or zero if no versions have been applied. Unlike the other
+// methods, it does not create the migrations table if it does not exist,
+// so it only requires read access to the database.
+func (m *Worker) CurrentVersion(ctx context.Context) (VersionID, error) {
+	if err := m.detectDriver(ctx); err != nil {
+		return 0, err
+	}
+	exists, err := m.drv.MigrationsTableExists(ctx, m.db, m.tableName())
+	if err != nil || !exists {
+		return 0, err
+	}
+	return m.currentVersion(ctx)
+}
+
+// VerifyChecksums returns the applied versions whose up migrations have
+// changed since they were applied, in ascending order. It does not
+// perform any migrations, so it is suitable for a periodic check for
+// drift between the database and the schema. Versions applied before
+// checksums were recorded are not checked. If versions have been applied
+// but none of them have a checksum, it returns ErrChecksumsNotRecorded.
+func (m *Worker) VerifyChecksums(ctx context.Context) ([]VersionID, error) {
+	if err := m.detectDriver(ctx); err != nil {
+		return nil, err
+	}
+	exists, err := m.drv.MigrationsTableExists(ctx, m.db, m.tableName())
+	if err != nil || !exists {
+		return nil, err
+	}
+	var ids []VersionID
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		recorded := len(vs.versions) == 0
+		for _, ver := range vs.versions {
+			if ver.Checksum != "" {
+				recorded = true
+				break
+			}
+		}
+		if !recorded {
+			return ErrChecksumsNotRecorded
+		}
+		ids = vs.checksumMismatches()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// checkApplied reports an error for each version applied to the
+// database that is not defined in the schema.
+func (m *Worker) checkApplied(ctx context.Context) error {
+	if err := m.detectDriver(ctx); err != nil {
+		return err
+	}
+	exists, err := m.drv.MigrationsTableExists(ctx, m.db, m.tableName())
+	if err != nil || !exists {
+		return err
+	}
+	var errs Errors
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		versions, err := m.listVersions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, ver := range versions {
+			if _, ok := m.planMap[ver.ID]; !ok {
+				errs = append(errs, &Error{
+					Version:     ver.ID,
+					Description: "applied to database but not defined in schema",
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Versions lists all of the database schema versions.
+func (m *Worker) Versions(ctx context.Context) ([]*Version, error) {
+	var versions []*Version
+	if err := m.init(ctx); err != nil {
+		return versions, err
+	}
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		versions = vs.versions
+
+		return nil
+	})
+	return versions, err
+}
+
+// Applied lists the database schema versions that have been successfully
+// applied, in ascending order. Failed versions are not included. No
+// migrations are performed.
+func (m *Worker) Applied(ctx context.Context) ([]*Version, error) {
+	var versions []*Version
+	if err := m.init(ctx); err != nil {
+		return versions, err
+	}
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, ver := range vs.versions {
+			if ver.AppliedAt != nil && !ver.Failed {
+				versions = append(versions, ver)
+			}
+		}
+
+		return nil
+	})
+	return versions, err
+}
+
+// Pending lists the database schema versions that have not been applied,
+// in the order that Up applies them. This is ascending order unless a
+// version depends on a later version (see Definition.DependsOn). No
+// migrations are performed.
+func (m *Worker) Pending(ctx context.Context) ([]*Version, error) {
+	var versions []*Version
+	if err := m.init(ctx); err != nil {
+		return versions, err
+	}
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, plan := range vs.unapplied {
+			versions = append(versions, vs.vmap[plan.id])
+		}
+
+		return nil
+	})
+	return versions, err
+}
+
+// Status returns a summary of the migration state of the database.
+func (m *Worker) Status(ctx context.Context) (*Status, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	status := &Status{}
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(vs.applied) > 0 {
+			status.CurrentVersion = vs.applied[0].id
+		}
+		status.LatestVersion = m.latestVersion()
+		status.PendingCount = len(vs.unapplied)
+		for _, ver := range vs.versions {
+			if ver.Failed {
+				status.HasFailed = true
+			}
+			if ver.Locked {
+				status.LockedVersions = append(status.LockedVersions, ver.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Capabilities reports the features of the database that affect how
+// migrations are performed. The database may be queried to determine
+// which driver to use, but the migrations table is not created.
+func (m *Worker) Capabilities(ctx context.Context) (*Capabilities, error) {
+	if err := m.detectDriver(ctx); err != nil {
+		return nil, err
+	}
+	c := &Capabilities{
+		TransactionalDDL:      m.drv.SupportsTransactionalDDL(),
+		IfExists:              m.dropStyle().ifExists,
+		DropIndexOnTable:      m.dropStyle().indexOnTable,
+		DropTriggerByName:     m.dropStyle().triggerName,
+		MultipleStatements:    !m.splitStatements(),
+		SchemaQualifiedTables: true,
+	}
+	if drv, ok := m.drv.(LockingDriver); ok {
+		c.AdvisoryLocks = drv.SupportsLocking()
+	}
+	_, c.SearchPath = m.drv.(SearchPathDriver)
+	_, c.DatabaseClock = m.drv.(DatabaseClockDriver)
+	return c, nil
+}
+
+func (m *Worker) init(ctx context.Context) error {
+	if m.initCalled {
+		return nil
+	}
+	if err := m.detectDriver(ctx); err != nil {
+		return err
+	}
+	var err error
+	if m.createTableSQL != nil || m.skipCreateTable || m.versionFuncs.custom() {
+		err = m.createTable(ctx)
+	} else {
+		err = m.drv.CreateMigrationsTable(ctx, m.db, m.tableName())
+	}
+	if err != nil {
+		return err
+	}
+	if m.storedSQL {
+		if m.versionFuncs.custom() {
+			return errors.New("cannot store migrations in a migrations table accessed by custom functions")
+		}
+		drv, ok := m.drv.(StoredSQLDriver)
+		if !ok {
+			return errors.New("database driver does not support storing migrations")
+		}
+		if !m.skipCreateTable {
+			if err := drv.AddSQLColumns(ctx, m.db, m.tableName()); err != nil {
+				return err
+			}
+		}
+	}
+	m.initCalled = true
+	return nil
+}
+
+// createTable creates the migrations table using the SQL specified by
+// WithCreateTableSQL, unless WithSkipCreateTable is specified, and checks
+// that the table has the expected columns. If the migrations table is
+// accessed by custom functions (see WithListVersionsFunc), the table is
+// not created, and it is checked by listing the versions.
+func (m *Worker) createTable(ctx context.Context) error {
+	tblname := m.tableName()
+	exists, err := m.drv.MigrationsTableExists(ctx, m.db, tblname)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if m.skipCreateTable || m.createTableSQL == nil {
+			return fmt.Errorf("migrations table %s does not exist, and must be created before migrating", tblname)
+		}
+		if _, err := m.db.ExecContext(ctx, m.createTableSQL(tblname)); err != nil {
+			return wrapf(err, "cannot create table %s", tblname)
+		}
+	}
+
+	// listing the versions selects all of the expected columns
+	err = m.transact(ctx, func(tx *sql.Tx) error {
+		_, err := m.listVersions(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return wrapf(err, "migrations table %s does not have the expected columns", tblname)
+	}
+	return nil
+}
+
+// migrate calls fn to perform migrations, and reports the result.
+func (m *Worker) migrate(ctx context.Context, fn func(r *Result) error) (*Result, error) {
+	if m.DryRun {
+		return m.migrateDryRun(ctx, fn)
+	}
+	var r *Result
+	err := m.withLock(ctx, func() error {
+		if err := m.init(ctx); err != nil {
+			return err
+		}
+		start := m.now()
+		startVersion, err := m.currentVersion(ctx)
+		if err != nil {
+			return err
+		}
+		r = &Result{
+			StartVersion: startVersion,
+		}
+		err = fn(r)
+		m.progress = nil
+		r.Duration = m.now().Sub(start)
+		r.EndVersion, _ = m.currentVersion(ctx)
+		return err
+	})
+	return r, err
+}
+
+// migrateDryRun calls fn to report the migrations that would be performed,
+// without acquiring the migration lock, and without creating or altering
+// the migrations table. If the migrations table does not exist, no versions
+// have been applied.
+func (m *Worker) migrateDryRun(ctx context.Context, fn func(r *Result) error) (*Result, error) {
+	if err := m.detectDriver(ctx); err != nil {
+		return nil, err
+	}
+	exists, err := m.drv.MigrationsTableExists(ctx, m.db, m.tableName())
+	if err != nil {
+		return nil, err
+	}
+	m.noTable = !exists
+	defer func() { m.noTable = false }()
+
+	start := m.now()
+	startVersion, err := m.currentVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r := &Result{
+		StartVersion: startVersion,
+		EndVersion:   startVersion,
+	}
+	err = fn(r)
+	r.Duration = m.now().Sub(start)
+	return r, err
+}
+
+// verifyChecksums checks that the up migrations for all applied versions
+// have not changed since they were applied. Versions applied before
+// checksums were recorded are not checked.
+func (m *Worker) verifyChecksums(ctx context.Context) error {
+	var mismatches []VersionID
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		mismatches = vs.checksumMismatches()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return m.checksumError(mismatches)
+}
+
+// checksumError returns an error listing the versions whose checksums
+// do not match, or logs a warning for each of them if specified by
+// WarnChecksumMismatch.
+func (m *Worker) checksumError(mismatches []VersionID) error {
+	if len(mismatches) == 0 {
+		return nil
+	}
+	var errs Errors
+	for _, id := range mismatches {
+		errs = append(errs, &Error{
+			Version:     id,
+			Description: "checksum mismatch: up migration has changed since it was applied",
+		})
+	}
+	if m.WarnChecksumMismatch {
+		for _, err := range errs {
+			m.warn(err.Description, "version", err.Version)
+		}
+		return nil
+	}
+	return errs
+}
+
+// detectDriver replaces the driver if the database needs to be
+// queried to determine the correct driver. The database is only
+// queried once.
+func (m *Worker) detectDriver(ctx context.Context) error {
+	if m.detected {
+		return nil
+	}
+	if d, ok := m.drv.(detectingDriver); ok {
+		drv, err := d.detect(ctx, m.db)
+		if err != nil {
+			return err
+		}
+		m.drv = drv
+	}
+	if d, ok := m.drv.(poolCheckingDriver); ok {
+		if msg := d.checkPool(ctx, m.db); msg != "" {
+			m.warn(msg)
+		}
+	}
+	m.detected = true
+	return nil
+}
+
+// withLock calls fn while holding the migration lock, so that
+// migrations are not performed concurrently by multiple processes.
+func (m *Worker) withLock(ctx context.Context, fn func() error) error {
+	if err := m.detectDriver(ctx); err != nil {
+		return err
+	}
+	lockCtx := ctx
+	if m.LockTimeout > 0 {
+		var cancel context.CancelFunc
+		lockCtx, cancel = context.WithTimeout(ctx, m.LockTimeout)
+		defer cancel()
+	}
+	conn, err := m.drv.AcquireLock(lockCtx, m.db, m.tableName(), m.LockTimeout)
+	if err != nil {
+		if ctx.Err() == nil && (lockCtx.Err() != nil || err == errLockTimeout) {
+			return fmt.Errorf("timed out after %v waiting for migration lock on %s", m.LockTimeout, m.tableName())
+		}
+		return wrapf(err, "cannot acquire migration lock on %s", m.tableName())
+	}
+	defer m.releaseLock(conn)
+
+	return fn()
+}
+
+// releaseLockTimeout is the time allowed for releasing the migration lock.
+const releaseLockTimeout = 10 * time.Second
+
+// releaseLock releases the migration lock acquired by withLock. The
+// lock is released even if the context used to acquire it has been
+// cancelled, for example during shutdown, so it uses a new context.
+func (m *Worker) releaseLock(conn *sql.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseLockTimeout)
+	defer cancel()
+	if err := m.drv.ReleaseLock(ctx, conn, m.tableName()); err != nil {
+		m.warn("cannot release migration lock", "table", m.tableName(), "error", err)
+	}
+}
+
+// currentVersion returns the highest applied version, or zero
+// if no versions have been applied.
+func (m *Worker) currentVersion(ctx context.Context) (VersionID, error) {
+	var id VersionID
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(vs.applied) > 0 {
+			id = vs.applied[0].id
+		}
+		return nil
+	})
+	return id, err
+}
+
+// now returns the current time.
+func (m *Worker) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+// appliedBy returns the value recorded as the application
+// or host that applied a version.
+func (m *Worker) appliedBy() string {
+	if m.AppliedBy != "" {
+		return m.AppliedBy
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// info logs an informational message, along with alternating
+// key/value pairs.
+func (m *Worker) info(msg string, keyvals ...interface{}) {
+	m.logf(false, msg, keyvals)
+}
+
+// warn logs a warning message, along with alternating key/value pairs.
+func (m *Worker) warn(msg string, keyvals ...interface{}) {
+	m.logf(true, msg, keyvals)
+}
+
+// logf logs a message using Logger or LogFunc. All messages are logged
+// by logf, which adds the key/value pairs returned by LogKeyvals.
+func (m *Worker) logf(warn bool, msg string, keyvals []interface{}) {
+	if m.Logger == nil && m.LogFunc == nil {
+		return
+	}
+	if m.LogKeyvals != nil {
+		// Force and Baseline use the "id" key, which was used
+		// before LogKeyvals was introduced.
+		var id VersionID
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			if v, ok := keyvals[i+1].(VersionID); ok && (keyvals[i] == "version" || keyvals[i] == "id") {
+				id = v
+				break
+			}
+		}
+		keyvals = append(m.LogKeyvals(id), keyvals...)
+	}
+	switch {
+	case m.Logger != nil && warn:
+		m.Logger.Warn(msg, keyvals...)
+	case m.Logger != nil:
+		m.Logger.Info(msg, keyvals...)
+	case warn:
+		m.logFunc("warning: "+msg, keyvals)
+	default:
+		m.logFunc(msg, keyvals)
+	}
+}
+
+// logFunc formats the message and key/value pairs for LogFunc,
+// eg "migrated up version=1".
+func (m *Worker) logFunc(msg string, keyvals []interface{}) {
+	if m.LogFunc == nil {
+		return
+	}
+	s := []string{msg}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		s = append(s, fmt.Sprintf("%v=%v", keyvals[i], keyvals[i+1]))
+	}
+	m.LogFunc(strings.Join(s, " "))
+}
+
+func (m *Worker) finished(ctx context.Context, msg string) error {
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
+		}
+		var keyvals []interface{}
+		if len(vs.applied) > 0 {
+			plan := vs.applied[0]
+			version := vs.vmap[plan.id]
+			keyvals = append(keyvals, "version", version.ID)
+			if version.Locked {
+				keyvals = append(keyvals, "status", "locked")
+			}
+			if version.Failed {
+				keyvals = append(keyvals, "status", "failed")
+			}
+		} else {
+			keyvals = append(keyvals, "version", 0)
+		}
+		m.info(msg, keyvals...)
+		return nil
+	})
+}
+
+func (m *Worker) transact(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return m.transactOpts(ctx, nil, fn)
+}
+
+// transactOpts performs fn in a transaction started with opts.
+func (m *Worker) transactOpts(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	tx, err := m.beginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tx); err != nil {
 		// cannot report an error rolling back
 		tx.Rollback()
 		return err
@@ -333,71 +1569,305 @@ func (m *Worker) transact(ctx context.Context, fn func(tx *sql.Tx) error) error
 	return nil
 }
 
-func (m *Worker) gotoOne(ctx context.Context, id VersionID) (more bool, err error) {
-	var (
-		upCount   int
-		downCount int
-	)
-	err = m.transact(ctx, func(tx *sql.Tx) error {
-		vs, err := m.getVersionSummary(ctx, tx)
+// beginTx starts a transaction, and sets the search path
+// for the transaction if one has been specified.
+func (m *Worker) beginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	tx, err := m.db.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, wrapf(err, "cannot begin tx")
+	}
+	if drv, ok := m.searchPathDriver(); ok {
+		if err = drv.SetSearchPath(ctx, tx, m.searchPath); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// gotoVersion migrates up or down to version id. Up migrations are only
+// performed if up is set, and down migrations are only performed if down
+// is set. The version summary is read once, and then kept up to date as
+// each migration is performed. It is only read again after a migration
+// that is performed outside of a transaction.
+func (m *Worker) gotoVersion(ctx context.Context, id VersionID, r *Result, up, down bool) error {
+	vs := &versionSummary{stale: true}
+	if m.progress == nil {
+		err := m.startProgress(ctx, func(vs *versionSummary) int {
+			var count int
+			if down {
+				count += vs.countDown(id)
+			}
+			if up {
+				count += vs.countUp(id)
+			}
+			return count
+		})
 		if err != nil {
 			return err
 		}
+	}
+	for {
+		if vs.stale {
+			err := m.transact(ctx, func(tx *sql.Tx) error {
+				fresh, err := m.getVersionSummary(ctx, tx)
+				if err != nil {
+					return err
+				}
+				*vs = *fresh
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
 		// check for any locked versions that would prevent rolling back
-		if err = vs.checkLocked(id); err != nil {
+		if err := vs.checkLocked(id); err != nil {
 			return err
 		}
-		// count down migrations
-		for _, applied := range vs.applied {
-			if applied.id <= id {
-				break
+
+		switch {
+		case down && len(vs.applied) > 0 && vs.applied[0].id > id:
+			downID, _, err := m.downOne(ctx, vs)
+			r.add(downID, false)
+			if err != nil {
+				return err
 			}
-			downCount++
+		case up && len(vs.unapplied) > 0 && vs.unapplied[0].id <= id:
+			upID, _, err := m.upOne(ctx, vs)
+			r.add(upID, true)
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
 		}
+	}
+}
 
-		// count up migrations
-		for _, unapplied := range vs.unapplied {
-			if unapplied.id > id {
+// dryRun logs the migrations required to migrate to version id without
+// performing them. If stopAtLock is set, down migrations stop at the
+// first locked version instead of reporting an error.
+//
+// SQL migrations are executed in a transaction that is rolled back, so
+// that any errors are reported, unless they cannot be rolled back because
+// they are performed outside of a transaction. Go functions are not called.
+func (m *Worker) dryRun(ctx context.Context, id VersionID, stopAtLock bool) error {
+	return m.dryRunPlans(ctx, func(vs *versionSummary) (down, up []*migrationPlan, err error) {
+		if !stopAtLock {
+			if err := vs.checkLocked(id); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, plan := range vs.applied {
+			if plan.id <= id {
+				break
+			}
+			if vs.vmap[plan.id].Locked {
+				m.info("locked", "version", plan.id)
 				break
 			}
-			upCount++
+			down = append(down, plan)
 		}
+		for _, plan := range vs.unapplied {
+			if plan.id > id {
+				break
+			}
+			up = append(up, plan)
+		}
+		return down, up, nil
+	})
+}
 
-		return nil
+// dryRunSteps logs the migrations that Steps would perform for n, without
+// performing them, and returns the number of migrations.
+func (m *Worker) dryRunSteps(ctx context.Context, n int) (int, error) {
+	var count int
+	err := m.dryRunPlans(ctx, func(vs *versionSummary) (down, up []*migrationPlan, err error) {
+		count = vs.countSteps(n)
+		if n > 0 {
+			return nil, vs.unapplied[:count], nil
+		}
+		return vs.applied[:count], nil, nil
 	})
+	return count, err
+}
+
+// dryRunPlans logs the down and up migrations selected by fn, in order,
+// without performing them. See dryRun.
+func (m *Worker) dryRunPlans(ctx context.Context, fn func(vs *versionSummary) (down, up []*migrationPlan, err error)) error {
+	tx, err := m.beginTx(ctx, nil)
 	if err != nil {
-		return false, err
+		return err
 	}
 
-	if downCount > 0 {
-		if _, err = m.downOne(ctx); err != nil {
-			return false, err
+	// a dry run never modifies the database
+	defer tx.Rollback()
+
+	vs, err := m.getVersionSummary(ctx, tx)
+	if err != nil {
+		return err
+	}
+	down, up, err := fn(vs)
+	if err != nil {
+		return err
+	}
+
+	for _, plan := range down {
+		m.info("dry run: migrate down", "version", plan.id)
+		m.info(strings.TrimSpace(plan.downDescription(m.dropStyle())))
+		if err = m.dryRunSQL(ctx, tx, plan.id, &plan.down, plan.downSQL(m.dropStyle())); err != nil {
+			return err
+		}
+	}
+
+	for _, plan := range up {
+		m.info("dry run: migrate up", "version", plan.id)
+		m.info(strings.TrimSpace(plan.up.description()))
+		if err = m.dryRunSQL(ctx, tx, plan.id, &plan.up, plan.up.sql); err != nil {
+			return err
 		}
-		downCount--
-	} else if upCount > 0 {
-		if _, err = m.upOne(ctx); err != nil {
-			return false, err
+	}
+
+	return nil
+}
+
+// dryRunSQL executes the SQL for action a in transaction tx, which is
+// rolled back by the caller. Actions performed by Go functions, and SQL
+// that is executed outside of a transaction, are not executed.
+func (m *Worker) dryRunSQL(ctx context.Context, tx *sql.Tx, id VersionID, a *action, query string) error {
+	if query == "" || a.dbFunc != nil || a.txFunc != nil || a.noTx || !m.drv.SupportsTransactionalDDL() {
+		return nil
+	}
+	return m.execSQL(ctx, tx, id, query)
+}
+
+// upOne migrates up one version, calling the BeforeEach and AfterEach
+// hooks if they are specified. See migrateUpOne.
+func (m *Worker) upOne(ctx context.Context, cached *versionSummary) (id VersionID, more bool, err error) {
+	ver, err := m.beforeEach(ctx, DirectionUp, cached)
+	if err != nil {
+		return 0, false, err
+	}
+	id, more, err = m.migrateUpOne(ctx, cached)
+	m.afterEach(ctx, ver, DirectionUp, err)
+	return id, more, err
+}
+
+// beforeEach calls the BeforeEach hook for the next migration in the
+// specified direction, and returns the version to be migrated. If there
+// are no hooks, or no migration to perform, it returns nil. The version
+// summary is read from the database unless cached is up to date.
+func (m *Worker) beforeEach(ctx context.Context, dir Direction, cached *versionSummary) (*Version, error) {
+	if m.BeforeEach == nil && m.AfterEach == nil && m.Progress == nil {
+		return nil, nil
+	}
+	var ver *Version
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		vs := cached
+		if vs == nil || vs.stale {
+			var err error
+			if vs, err = m.getVersionSummaryAllowFailed(ctx, tx); err != nil {
+				return err
+			}
+		}
+		if dir == DirectionUp && len(vs.unapplied) > 0 {
+			ver = vs.vmap[vs.unapplied[0].id]
+		}
+		if dir == DirectionDown && len(vs.applied) > 0 {
+			if v := vs.vmap[vs.applied[0].id]; !v.Locked {
+				ver = v
+			}
+		}
+		return nil
+	})
+	if err != nil || ver == nil {
+		return nil, err
+	}
+	if m.BeforeEach != nil {
+		if err = m.BeforeEach(ctx, ver, dir); err != nil {
+			return nil, err
+		}
+	}
+	if m.Progress != nil && m.progress != nil {
+		m.Progress(m.progress.done, m.progress.total, ver)
+		m.progress.done++
+	}
+	return ver, nil
+}
+
+// A progress records the number of migrations performed by a single
+// call to Up, Down, etc, for reporting by the Progress hook.
+type progress struct {
+	done  int // migrations performed so far
+	total int // migrations planned at the start
+}
+
+// startProgress counts the migrations planned at the start of a call
+// to Up, Down, etc, for reporting by the Progress hook. The count
+// function is called with the current version summary.
+func (m *Worker) startProgress(ctx context.Context, count func(vs *versionSummary) int) error {
+	if m.Progress == nil {
+		return nil
+	}
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummaryAllowFailed(ctx, tx)
+		if err != nil {
+			return err
 		}
-		upCount--
+		m.progress = &progress{total: count(vs)}
+		return nil
+	})
+}
+
+// onFailure calls the OnFailure hook if it is specified.
+func (m *Worker) onFailure(ctx context.Context, id VersionID, dir Direction, err error) {
+	if m.OnFailure != nil {
+		m.OnFailure(ctx, id, dir, err)
 	}
+}
 
-	more = upCount+downCount > 0
-	return more, nil
+// afterEach calls the AfterEach hook if the version is not nil.
+func (m *Worker) afterEach(ctx context.Context, ver *Version, dir Direction, err error) {
+	if m.AfterEach != nil && ver != nil {
+		m.AfterEach(ctx, ver, dir, err)
+	}
 }
 
-// upOne migrates up one version using a transaction if possible.
-// Reports true if there is another up migration pending at the end,
+// migrateUpOne migrates up one version using a transaction if possible.
+// Reports the version migrated, or zero if no migration was performed.
+// Also reports true if there is another up migration pending at the end,
 // false otherwise.
-func (m *Worker) upOne(ctx context.Context) (more bool, err error) {
+//
+// If cached is not nil and is up to date, it is used instead of reading
+// the version summary from the database, and it is updated to reflect
+// the migration performed.
+func (m *Worker) migrateUpOne(ctx context.Context, cached *versionSummary) (id VersionID, more bool, err error) {
 	var (
-		noTx bool
-		id   VersionID
+		noTx    bool
+		vs      *versionSummary
+		version *Version
+		target  VersionID // version selected by the first attempt
+		applied bool      // a failed attempt was committed after all
 	)
 
-	err = m.transact(ctx, func(tx *sql.Tx) error {
-		vs, err := m.getVersionSummary(ctx, tx)
-		if err != nil {
-			return err
+	err = m.retry(ctx, cached, func(tx *sql.Tx) error {
+		vs = cached
+		if vs == nil || vs.stale {
+			var err error
+			if vs, err = m.getVersionSummary(ctx, tx); err != nil {
+				return err
+			}
+		}
+
+		if target != 0 && (len(vs.unapplied) == 0 || vs.unapplied[0].id != target) {
+			// A previous attempt reported an error committing the
+			// transaction, but the commit succeeded.
+			id = target
+			applied = true
+			more = len(vs.unapplied) > 0
+			return nil
 		}
 
 		if len(vs.unapplied) == 0 {
@@ -407,7 +1877,8 @@ func (m *Worker) upOne(ctx context.Context) (more bool, err error) {
 
 		// select the first plan
 		plan := vs.unapplied[0]
-		appliedAt := time.Now()
+		target = plan.id
+		appliedAt := m.now()
 		more = len(vs.unapplied) > 1
 
 		if upTx := plan.up.txFunc; upTx != nil {
@@ -416,49 +1887,196 @@ func (m *Worker) upOne(ctx context.Context) (more bool, err error) {
 			if err = upTx(ctx, tx); err != nil {
 				return wrapf(err, "%d", plan.id)
 			}
-		} else {
-			if !m.drv.SupportsTransactionalDDL() || plan.up.dbFunc != nil {
-				// Either the driver does not support transactional
-				// DDL, or the up migration has been specified using
-				// a non-transactional function.
-				id = plan.id
-				noTx = true
-				return nil
+		} else {
+			if !m.drv.SupportsTransactionalDDL() || plan.up.dbFunc != nil || plan.up.noTx {
+				// Either the driver does not support transactional
+				// DDL, or the up migration has been specified using
+				// a non-transactional function, or it contains
+				// statements that cannot run in a transaction.
+				id = plan.id
+				noTx = true
+				return nil
+			}
+			if err = m.execSQL(ctx, tx, plan.id, plan.up.sql); err != nil {
+				return err
+			}
+		}
+
+		if verifyTx := plan.verify.txFunc; verifyTx != nil {
+			if err = verifyTx(ctx, tx); err != nil {
+				return wrapf(err, "%d: verify failed", plan.id)
+			}
+		}
+
+		// At this point the migration has been performed in a transaction,
+		// so update the schema migrations table.
+		version = &Version{
+			ID:          plan.id,
+			Description: plan.description,
+			AppliedAt:   &appliedAt,
+			Duration:    m.now().Sub(appliedAt),
+			Checksum:    plan.checksum,
+			AppliedBy:   m.appliedBy(),
+		}
+
+		if err = m.insertVersion(ctx, tx, version); err != nil {
+			return wrapf(err, "%d", plan.id)
+		}
+
+		id = plan.id
+		m.info("migrated up", "version", plan.id)
+
+		return nil
+	})
+	if err != nil {
+		cached.invalidate()
+		return 0, more, canceled(ctx, target, err)
+	}
+
+	if noTx {
+		// The migration needs to be performed outside of a transaction
+		cached.invalidate()
+		if err = m.upOneNoTx(ctx, id); err != nil {
+			return 0, more, err
+		}
+		m.info("migrated up", "version", id)
+	} else if id != 0 {
+		if cached != nil {
+			cached.update(vs)
+			if !applied {
+				cached.markApplied(version)
+			}
+		}
+		if err = m.verifyDB(ctx, id); err != nil {
+			cached.invalidate()
+			return 0, more, err
+		}
+	}
+
+	return id, more, nil
+}
+
+// upInOneTx performs all pending up migrations in a single transaction.
+// See AllInOneTransaction.
+func (m *Worker) upInOneTx(ctx context.Context, r *Result) error {
+	if !m.drv.SupportsTransactionalDDL() {
+		return errors.New("cannot migrate up in one transaction: database does not support transactional DDL")
+	}
+	var applied []VersionID
+	err := m.transactOpts(ctx, m.TxOptions, func(tx *sql.Tx) error {
+		vs, err := m.getVersionSummary(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, plan := range vs.unapplied {
+			if plan.up.txFunc == nil && (plan.up.dbFunc != nil || plan.up.noTx) {
+				return fmt.Errorf("cannot migrate up in one transaction: version %d is performed outside of a transaction", plan.id)
+			}
+		}
+		for _, plan := range vs.unapplied {
+			if m.Progress != nil && m.progress != nil {
+				m.Progress(m.progress.done, m.progress.total, vs.vmap[plan.id])
+				m.progress.done++
 			}
-			_, err = tx.ExecContext(ctx, plan.up.sql)
-			if err != nil {
+			appliedAt := m.now()
+			if upTx := plan.up.txFunc; upTx != nil {
+				if err = upTx(ctx, tx); err != nil {
+					return wrapf(err, "%d", plan.id)
+				}
+			} else if err = m.execSQL(ctx, tx, plan.id, plan.up.sql); err != nil {
+				return err
+			}
+			if verifyTx := plan.verify.txFunc; verifyTx != nil {
+				if err = verifyTx(ctx, tx); err != nil {
+					return wrapf(err, "%d: verify failed", plan.id)
+				}
+			}
+			ver := &Version{
+				ID:          plan.id,
+				Description: plan.description,
+				AppliedAt:   &appliedAt,
+				Duration:    m.now().Sub(appliedAt),
+				Checksum:    plan.checksum,
+				AppliedBy:   m.appliedBy(),
+			}
+			if err = m.insertVersion(ctx, tx, ver); err != nil {
 				return wrapf(err, "%d", plan.id)
 			}
+			applied = append(applied, plan.id)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		// At this point the migration has been performed in a transaction,
-		// so update the schema migrations table.
-		version := &Version{
-			ID:        plan.id,
-			AppliedAt: &appliedAt,
-		}
-
-		if err = m.drv.InsertVersion(ctx, tx, m.tableName(), version); err != nil {
-			return wrapf(err, "%d", plan.id)
+	for _, id := range applied {
+		r.add(id, true)
+		m.info("migrated up", "version", id)
+	}
+	for _, id := range applied {
+		if err = m.verifyDB(ctx, id); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		m.log(fmt.Sprintf("migrated up version=%d", plan.id))
-
+// verifyDB performs the DBFunc check for version id after its up
+// migration has been committed. If the check fails, the version is
+// marked as failed.
+func (m *Worker) verifyDB(ctx context.Context, id VersionID) error {
+	verifyDB := m.planMap[id].verify.dbFunc
+	if verifyDB == nil {
+		return nil
+	}
+	err := verifyDB(ctx, m.db)
+	if err == nil {
 		return nil
+	}
+	err = wrapf(err, "%d: verify failed", id)
+	txErr := m.transact(ctx, func(tx *sql.Tx) error {
+		return m.setVersionFailed(ctx, tx, id, true)
 	})
-	if err != nil {
-		return more, err
+	if txErr != nil {
+		return txErr
 	}
+	m.onFailure(ctx, id, DirectionUp, err)
+	return err
+}
 
-	if noTx {
-		// The migration needs to be performed outside of a transaction
-		if err = m.upOneNoTx(ctx, id); err != nil {
-			return more, err
-		}
-		m.log(fmt.Sprintf("migrated up version=%d", id))
+// canceled returns the context error, wrapped with the version being
+// migrated, if err is the result of the context being cancelled while
+// migrating the version in a transaction, which has been rolled back.
+// Otherwise it returns err.
+func canceled(ctx context.Context, id VersionID, err error) error {
+	if ctx.Err() == nil || id == 0 {
+		return err
 	}
+	return wrapf(ctx.Err(), "%d", id)
+}
 
-	return more, nil
+// retry performs fn in a transaction started with TxOptions, and performs
+// it again in a new transaction if it fails with an error that the Retry
+// policy reports is retryable. The cached version summary is invalidated
+// before each retry, so that fn reads the current state of the database.
+func (m *Worker) retry(ctx context.Context, cached *versionSummary, fn func(tx *sql.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := m.transactOpts(ctx, m.TxOptions, fn)
+		if err == nil || ctx.Err() != nil || !m.Retry.retryable(err, attempt) {
+			return err
+		}
+		delay := m.Retry.delay(attempt)
+		m.warn("retrying after error", "attempt", attempt, "delay", delay, "error", err)
+		cached.invalidate()
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
 }
 
 func (m *Worker) upOneNoTx(ctx context.Context, id VersionID) error {
@@ -467,25 +2085,24 @@ func (m *Worker) upOneNoTx(ctx context.Context, id VersionID) error {
 		plan *migrationPlan
 	)
 
-	for _, p := range m.schema.plans {
-		if p.id == id {
-			plan = p
-			break
-		}
-	}
+	plan = m.planMap[id]
 	if plan == nil {
 		return fmt.Errorf("missing plan for version %d", id)
 	}
 
 	// create version record with failed status
+	start := m.now()
 	err = m.transact(ctx, func(tx *sql.Tx) error {
-		now := time.Now()
+		now := m.now()
 		ver := &Version{
-			ID:        id,
-			AppliedAt: &now,
-			Failed:    true,
+			ID:          id,
+			Description: plan.description,
+			AppliedAt:   &now,
+			Failed:      true,
+			Checksum:    plan.checksum,
+			AppliedBy:   m.appliedBy(),
 		}
-		return m.drv.InsertVersion(ctx, tx, m.tableName(), ver)
+		return m.insertVersion(ctx, tx, ver)
 	})
 	if err != nil {
 		return err
@@ -493,18 +2110,35 @@ func (m *Worker) upOneNoTx(ctx context.Context, id VersionID) error {
 
 	if upDB := plan.up.dbFunc; upDB != nil {
 		if err = upDB(ctx, m.db); err != nil {
-			return wrapf(err, "%d", id)
+			err = wrapf(err, "%d", id)
 		}
 	} else {
-		_, err = m.db.ExecContext(ctx, plan.up.sql)
+		err = m.execNoTx(ctx, id, plan.up.sql)
+	}
+	if verifyTx := plan.verify.txFunc; verifyTx != nil && err == nil {
+		err = m.transact(ctx, func(tx *sql.Tx) error {
+			return verifyTx(ctx, tx)
+		})
 		if err != nil {
-			return wrapf(err, "%d", id)
+			err = wrapf(err, "%d: verify failed", id)
+		}
+	}
+	if verifyDB := plan.verify.dbFunc; verifyDB != nil && err == nil {
+		if err = verifyDB(ctx, m.db); err != nil {
+			err = wrapf(err, "%d: verify failed", id)
 		}
 	}
+	if err != nil {
+		m.onFailure(ctx, id, DirectionUp, err)
+		return err
+	}
 
 	// success, mark transaction as successful
 	err = m.transact(ctx, func(tx *sql.Tx) error {
-		return m.drv.SetVersionFailed(ctx, tx, m.tableName(), id, false)
+		if err := m.setVersionDuration(ctx, tx, id, m.now().Sub(start)); err != nil {
+			return err
+		}
+		return m.setVersionFailed(ctx, tx, id, false)
 	})
 	if err != nil {
 		return err
@@ -513,19 +2147,50 @@ func (m *Worker) upOneNoTx(ctx context.Context, id VersionID) error {
 	return nil
 }
 
-// downOne migrates down one version using a transaction if possible.
-// Reports true if there is another down migration available,
+// downOne migrates down one version, calling the BeforeEach and AfterEach
+// hooks if they are specified. See migrateDownOne.
+func (m *Worker) downOne(ctx context.Context, cached *versionSummary) (id VersionID, more bool, err error) {
+	ver, err := m.beforeEach(ctx, DirectionDown, cached)
+	if err != nil {
+		return 0, false, err
+	}
+	id, more, err = m.migrateDownOne(ctx, cached)
+	m.afterEach(ctx, ver, DirectionDown, err)
+	return id, more, err
+}
+
+// migrateDownOne migrates down one version using a transaction if possible.
+// Reports the version migrated, or zero if no migration was performed.
+// Also reports true if there is another down migration available,
 // false otherwise.
-func (m *Worker) downOne(ctx context.Context) (more bool, err error) {
+//
+// If cached is not nil and is up to date, it is used instead of reading
+// the version summary from the database, and it is updated to reflect
+// the migration performed.
+func (m *Worker) migrateDownOne(ctx context.Context, cached *versionSummary) (id VersionID, more bool, err error) {
 	var (
-		noTx bool
-		id   VersionID
+		noTx     bool
+		vs       *versionSummary
+		target   VersionID // version selected by the first attempt
+		reverted bool      // a failed attempt was committed after all
 	)
 
-	err = m.transact(ctx, func(tx *sql.Tx) error {
-		vs, err := m.getVersionSummary(ctx, tx)
-		if err != nil {
-			return err
+	err = m.retry(ctx, cached, func(tx *sql.Tx) error {
+		vs = cached
+		if vs == nil || vs.stale {
+			var err error
+			if vs, err = m.getVersionSummary(ctx, tx); err != nil {
+				return err
+			}
+		}
+
+		if target != 0 && (len(vs.applied) == 0 || vs.applied[0].id != target) {
+			// A previous attempt reported an error committing the
+			// transaction, but the commit succeeded.
+			id = target
+			reverted = true
+			more = len(vs.applied) > 0
+			return nil
 		}
 
 		if len(vs.applied) == 0 {
@@ -534,21 +2199,19 @@ func (m *Worker) downOne(ctx context.Context) (more bool, err error) {
 
 		// the applied plan that will be reversed
 		plan := vs.applied[0]
-		var version *Version
-		for _, ver := range vs.versions {
-			if ver.ID == plan.id {
-				version = ver
-				break
-			}
-		}
+		target = plan.id
+		version := vs.vmap[plan.id]
 
 		if version.Locked {
-			m.log(fmt.Sprintf("locked version=%d", version.ID))
+			m.info("locked", "version", version.ID)
 			return nil
 		}
 
 		more = len(vs.applied) > 1
 
+		if err = plan.downError(); err != nil {
+			return err
+		}
 		if downTx := plan.down.txFunc; downTx != nil {
 			// Regardless of whether the driver supports transactional
 			// migrations, this migration uses a transaction.
@@ -556,41 +2219,164 @@ func (m *Worker) downOne(ctx context.Context) (more bool, err error) {
 				return wrapf(err, "%d", plan.id)
 			}
 		} else {
-			if !m.drv.SupportsTransactionalDDL() || plan.down.dbFunc != nil {
+			if !m.drv.SupportsTransactionalDDL() || plan.down.dbFunc != nil || plan.down.noTx {
 				// Either the driver does not support transactional
-				// DDL, or the up migration has been specified using
-				// a non-transactional function.
+				// DDL, or the down migration has been specified using
+				// a non-transactional function, or it contains
+				// statements that cannot run in a transaction.
 				id = plan.id
 				noTx = true
 				return nil
 			}
-			_, err = tx.ExecContext(ctx, plan.down.sql)
-			if err != nil {
-				return wrapf(err, "%d", plan.id)
+			if err = m.execSQL(ctx, tx, plan.id, plan.downSQL(m.dropStyle())); err != nil {
+				return err
 			}
 		}
 
 		// At this point the migration has been performed in a transaction,
 		// so update the schema migrations table.
-		if err = m.drv.DeleteVersion(ctx, tx, m.tableName(), version.ID); err != nil {
+		if err = m.deleteVersion(ctx, tx, version.ID); err != nil {
 			return wrapf(err, "%d", plan.id)
 		}
-		m.log(fmt.Sprintf("migrated down version=%d", plan.id))
+		id = plan.id
+		m.info("migrated down", "version", plan.id)
 
 		return nil
 	})
 	if err != nil {
-		return more, err
+		cached.invalidate()
+		return 0, more, canceled(ctx, target, err)
 	}
 
 	if noTx {
 		// The migration needs to be performed outside of a transaction
+		cached.invalidate()
 		if err = m.downOneNoTx(ctx, id); err != nil {
-			return false, err
+			return 0, false, err
+		}
+		m.info("migrated down", "version", id)
+	} else if cached != nil && id != 0 {
+		cached.update(vs)
+		if !reverted {
+			cached.markReverted()
+		}
+	}
+	return id, more, err
+}
+
+// execNoTx executes the SQL for an up migration outside of a transaction.
+// The statements are executed one at a time, so that if a statement fails,
+// the statements before it are known to have been applied. The failed
+// statement is logged, and recorded in the migrations table if the
+// driver supports it. If the SQL cannot be split safely, it is executed
+// in a single call, and the failed statement is not known.
+func (m *Worker) execNoTx(ctx context.Context, id VersionID, query string) error {
+	if !splittable(query) {
+		if err := m.execStatement(ctx, m.db, id, 0, query); err != nil {
+			m.warn("migration failed", "version", id)
+			return err
+		}
+		return nil
+	}
+	stmts := splitStatements(query)
+	for i, stmt := range stmts {
+		err := m.execStatement(ctx, m.db, id, i+1, stmt)
+		if err == nil {
+			continue
+		}
+		m.warn("migration failed", "version", id, "statement", i+1, "applied", i)
+		if drv, ok := m.drv.(StatementProgressDriver); ok && !m.versionFuncs.custom() {
+			txErr := m.transact(ctx, func(tx *sql.Tx) error {
+				return drv.SetVersionFailedStatement(ctx, tx, m.tableName(), id, i+1)
+			})
+			if txErr != nil {
+				m.warn("cannot record failed statement", "version", id, "error", txErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// execSQL executes the SQL for a migration, splitting it into
+// individual statements if necessary, and if it can be split safely.
+func (m *Worker) execSQL(ctx context.Context, e execer, id VersionID, query string) error {
+	stmts := splitStatements(query)
+	if !m.splitStatements() || !splittable(query) {
+		var index int
+		if len(stmts) == 1 {
+			// the failed statement is known
+			index = 1
+		}
+		return m.execStatement(ctx, e, id, index, query)
+	}
+	for i, stmt := range stmts {
+		if err := m.execStatement(ctx, e, id, i+1, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropStyle returns the style in which derived down migrations
+// drop objects, as reported by the driver.
+func (m *Worker) dropStyle() dropStyle {
+	var style dropStyle
+	if drv, ok := m.drv.(DropIfExistsDriver); ok {
+		style.ifExists = drv.SupportsDropIfExists()
+	}
+	if drv, ok := m.drv.(DropIndexOnTableDriver); ok {
+		style.indexOnTable = drv.DropIndexOnTable()
+	}
+	if drv, ok := m.drv.(DropTriggerByNameDriver); ok {
+		style.triggerName = drv.DropTriggerByName()
+	}
+	return style
+}
+
+// splitStatements reports whether the SQL for each migration
+// is executed one statement at a time.
+func (m *Worker) splitStatements() bool {
+	if m.SplitStatements {
+		return true
+	}
+	if drv, ok := m.drv.(MultiStatementDriver); ok {
+		return !drv.SupportsMultipleStatements()
+	}
+	return false
+}
+
+// execStatement executes SQL, cancelling it if it does not complete
+// within the statement timeout. If index is not zero, the SQL is the
+// statement at index in the migration, and an error is reported as a
+// StatementError.
+func (m *Worker) execStatement(ctx context.Context, e execer, id VersionID, index int, query string) error {
+	stmtCtx := ctx
+	if m.StatementTimeout > 0 {
+		var cancel context.CancelFunc
+		stmtCtx, cancel = context.WithTimeout(ctx, m.StatementTimeout)
+		defer cancel()
+	}
+	if _, err := e.ExecContext(stmtCtx, query); err != nil {
+		if ctx.Err() == nil && stmtCtx.Err() == context.DeadlineExceeded {
+			return wrapf(err, "migration %d timed out after %v", id, m.StatementTimeout)
 		}
-		m.log(fmt.Sprintf("migrated down version=%d", id))
+		if stmts := splitStatements(query); index > 0 && len(stmts) == 1 {
+			return &StatementError{
+				Version: id,
+				Index:   index,
+				SQL:     stmts[0],
+				Err:     err,
+			}
+		}
+		return wrapf(err, "%d", id)
 	}
-	return more, err
+	return nil
 }
 
 func (m *Worker) downOneNoTx(ctx context.Context, id VersionID) error {
@@ -599,19 +2385,14 @@ func (m *Worker) downOneNoTx(ctx context.Context, id VersionID) error {
 		plan *migrationPlan
 	)
 
-	for _, p := range m.schema.plans {
-		if p.id == id {
-			plan = p
-			break
-		}
-	}
+	plan = m.planMap[id]
 	if plan == nil {
 		return fmt.Errorf("missing plan for version %d", id)
 	}
 
 	// mark version as failed
 	err = m.transact(ctx, func(tx *sql.Tx) error {
-		return m.drv.SetVersionFailed(ctx, tx, m.tableName(), id, false)
+		return m.setVersionFailed(ctx, tx, id, true)
 	})
 	if err != nil {
 		return err
@@ -619,18 +2400,19 @@ func (m *Worker) downOneNoTx(ctx context.Context, id VersionID) error {
 
 	if downDB := plan.down.dbFunc; downDB != nil {
 		if err = downDB(ctx, m.db); err != nil {
-			return wrapf(err, "%d", id)
+			err = wrapf(err, "%d", id)
 		}
 	} else {
-		_, err = m.db.ExecContext(ctx, plan.down.sql)
-		if err != nil {
-			return wrapf(err, "%d", id)
-		}
+		err = m.execSQL(ctx, m.db, id, plan.downSQL(m.dropStyle()))
+	}
+	if err != nil {
+		m.onFailure(ctx, id, DirectionDown, err)
+		return err
 	}
 
 	// success, so delete version record
 	err = m.transact(ctx, func(tx *sql.Tx) error {
-		return m.drv.DeleteVersion(ctx, tx, m.tableName(), id)
+		return m.deleteVersion(ctx, tx, id)
 	})
 	if err != nil {
 		return err
@@ -639,20 +2421,104 @@ func (m *Worker) downOneNoTx(ctx context.Context, id VersionID) error {
 	return nil
 }
 
+// listVersionsPageSize is the maximum number of rows read from the
+// migrations table by each call to RangeListDriver.ListVersionsRange.
+var listVersionsPageSize = 1000
+
+// listVersions returns all rows in the migrations table,
+// in ascending order of version.
 func (m *Worker) listVersions(ctx context.Context, tx *sql.Tx) ([]*Version, error) {
-	return m.drv.ListVersions(ctx, tx, m.tableName())
+	var (
+		versions []*Version
+		err      error
+	)
+	if list := m.versionFuncs.list; list != nil {
+		versions, err = list(ctx, tx, m.tableName())
+	} else if drv, ok := m.drv.(RangeListDriver); ok {
+		return m.listVersionsRange(ctx, tx, drv)
+	} else {
+		versions, err = m.drv.ListVersions(ctx, tx, m.tableName())
+	}
+	if err != nil {
+		return nil, err
+	}
+	less := func(i, j int) bool {
+		return versions[i].ID < versions[j].ID
+	}
+	if !sort.SliceIsSorted(versions, less) {
+		sort.Slice(versions, less)
+	}
+	return versions, nil
+}
+
+// listVersionsRange returns all rows in the migrations table, in ascending
+// order of version, reading them one page at a time, so that large tables
+// are not read in a single query.
+func (m *Worker) listVersionsRange(ctx context.Context, tx *sql.Tx, drv RangeListDriver) ([]*Version, error) {
+	var (
+		versions []*Version
+		after    VersionID
+	)
+	for {
+		page, err := drv.ListVersionsRange(ctx, tx, m.tableName(), after, listVersionsPageSize)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, page...)
+		if len(page) < listVersionsPageSize {
+			return versions, nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+// addStoredSQL sets the Up and Down fields of each version to the
+// migrations stored in the migrations table. See WithStoredSQL.
+func (m *Worker) addStoredSQL(ctx context.Context, tx *sql.Tx, versions []*Version) error {
+	drv, ok := m.drv.(StoredSQLDriver)
+	if !ok || !m.storedSQL {
+		return nil
+	}
+	stored, err := drv.ListVersionSQL(ctx, tx, m.tableName())
+	if err != nil {
+		return err
+	}
+	vmap := make(map[VersionID]*Version, len(stored))
+	for _, ver := range stored {
+		vmap[ver.ID] = ver
+	}
+	for _, ver := range versions {
+		if s := vmap[ver.ID]; s != nil {
+			ver.Up = s.Up
+			ver.Down = s.Down
+		}
+	}
+	return nil
 }
 
 func (m *Worker) tableName() string {
-	tn := m.schema.MigrationsTable
+	tn := m.migrationsTable
 	if tn == "" {
-		tn = DefaultMigrationsTable
+		tn = m.schema.migrationsTable()
+	}
+	if _, ok := m.searchPathDriver(); ok && !strings.Contains(tn, ".") {
+		tn = m.searchPath + "." + tn
 	}
 	return tn
 }
 
+// searchPathDriver returns the driver if a search path has been
+// specified and the driver supports it.
+func (m *Worker) searchPathDriver() (SearchPathDriver, bool) {
+	if m.searchPath == "" {
+		return nil, false
+	}
+	drv, ok := m.drv.(SearchPathDriver)
+	return drv, ok
+}
+
 func (m *Worker) checkVersion(version VersionID) error {
-	if _, ok := m.schema.definitions[version]; !ok {
+	if _, ok := m.planMap[version]; !ok {
 		return fmt.Errorf("invalid schema version id=%d", version)
 	}
 	return nil
@@ -662,8 +2528,132 @@ type versionSummary struct {
 	id        VersionID              // highest applied version
 	versions  []*Version             // applied versions, in ascending order
 	applied   []*migrationPlan       // applied plans, in reverse order
-	unapplied []*migrationPlan       // unapplied plans, in ascending order
+	unapplied []*migrationPlan       // unapplied plans, in the order they are applied
 	vmap      map[VersionID]*Version // map version id to version
+	stale     bool                   // must be read again from the database
+	dropStyle dropStyle              // how derived down migrations drop objects
+}
+
+// invalidate marks the version summary as stale, so that it is read
+// again from the database before it is next used. It is safe to call
+// with a nil summary.
+func (vs *versionSummary) invalidate() {
+	if vs != nil {
+		vs.stale = true
+	}
+}
+
+// update replaces the contents of the version summary with fresh,
+// which has just been read from the database.
+func (vs *versionSummary) update(fresh *versionSummary) {
+	if fresh != vs {
+		*vs = *fresh
+	}
+}
+
+// markApplied updates the version summary after the first unapplied
+// plan has been applied in a transaction, recording version ver.
+func (vs *versionSummary) markApplied(ver *Version) {
+	plan := vs.unapplied[0]
+	vs.unapplied = vs.unapplied[1:]
+	vs.applied = append([]*migrationPlan{plan}, vs.applied...)
+	ver.Up = plan.up.description()
+	ver.Down = plan.downDescription(vs.dropStyle)
+	ver.NoTx = plan.noTx()
+	vs.replaceVersion(ver)
+}
+
+// markReverted updates the version summary after the most recently
+// applied plan has been reversed in a transaction.
+func (vs *versionSummary) markReverted() {
+	plan := vs.applied[0]
+	vs.applied = vs.applied[1:]
+	vs.unapplied = append([]*migrationPlan{plan}, vs.unapplied...)
+	vs.replaceVersion(&Version{
+		ID:          plan.id,
+		Description: plan.description,
+		Checksum:    plan.checksum,
+		NoTx:        plan.noTx(),
+		Up:          plan.up.description(),
+		Down:        plan.downDescription(vs.dropStyle),
+	})
+}
+
+// replaceVersion replaces the version with the same id as ver,
+// and updates the highest applied version.
+func (vs *versionSummary) replaceVersion(ver *Version) {
+	vs.vmap[ver.ID] = ver
+	vs.id = 0
+	for i, v := range vs.versions {
+		if v.ID == ver.ID {
+			vs.versions[i] = ver
+			v = ver
+		}
+		if v.AppliedAt != nil && v.ID > vs.id {
+			vs.id = v.ID
+		}
+	}
+}
+
+// checksumMismatches returns the applied versions, in ascending order,
+// whose checksums differ from the checksums of their up migrations.
+// Versions without a checksum are ignored.
+func (vs *versionSummary) checksumMismatches() []VersionID {
+	var ids []VersionID
+	for i := len(vs.applied) - 1; i >= 0; i-- {
+		plan := vs.applied[i]
+		ver := vs.vmap[plan.id]
+		if ver.Checksum != "" && ver.Checksum != plan.checksum {
+			ids = append(ids, plan.id)
+		}
+	}
+	return ids
+}
+
+// countDown returns the number of down migrations required to migrate
+// down to version id, stopping at the first locked version.
+func (vs *versionSummary) countDown(id VersionID) int {
+	var count int
+	for _, applied := range vs.applied {
+		if applied.id <= id || vs.vmap[applied.id].Locked {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+// countUp returns the number of up migrations required to migrate
+// up to version id.
+func (vs *versionSummary) countUp(id VersionID) int {
+	var count int
+	for _, unapplied := range vs.unapplied {
+		if unapplied.id > id {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+// countSteps returns the number of migrations performed by Steps for n:
+// up to n up migrations if n is positive, or up to |n| down migrations,
+// stopping at the first locked version, if n is negative.
+func (vs *versionSummary) countSteps(n int) int {
+	if n > 0 {
+		if len(vs.unapplied) < n {
+			return len(vs.unapplied)
+		}
+		return n
+	}
+	var count int
+	for _, applied := range vs.applied {
+		if count >= -n || vs.vmap[applied.id].Locked {
+			break
+		}
+		count++
+	}
+	return count
 }
 
 func (vs *versionSummary) checkLocked(id VersionID) error {
@@ -672,7 +2662,7 @@ func (vs *versionSummary) checkLocked(id VersionID) error {
 			break
 		}
 		if vs.vmap[applied.id].Locked {
-			return fmt.Errorf("database schema version locked id=%d", applied.id)
+			return &LockedError{Version: applied.id}
 		}
 	}
 	return nil
@@ -697,11 +2687,17 @@ func (m *Worker) getVersionSummaryAllowFailed(ctx context.Context, tx *sql.Tx) (
 		err error
 	)
 
-	vs.versions, err = m.listVersions(ctx, tx)
-	if err != nil {
-		return nil, err
+	if !m.noTable {
+		vs.versions, err = m.listVersions(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		if err = m.addStoredSQL(ctx, tx, vs.versions); err != nil {
+			return nil, err
+		}
 	}
 	vs.vmap = make(map[VersionID]*Version)
+	vs.dropStyle = m.dropStyle()
 
 	// prepare set of version ids that have been applied
 	applied := make(map[VersionID]struct{})
@@ -713,46 +2709,160 @@ func (m *Worker) getVersionSummaryAllowFailed(ctx context.Context, tx *sql.Tx) (
 		applied[ver.ID] = struct{}{}
 	}
 
-	// find list of unapplied versions, in order
-	for _, plan := range m.schema.plans {
+	// Find lists of applied and unapplied versions. The plans are in
+	// the order they are applied, so the applied plans are reversed once found,
+	// and the unapplied versions are merged with the applied versions.
+	var unapplied []*Version
+	for _, plan := range m.plans {
 		var ver *Version
 		if _, ok := applied[plan.id]; ok {
 			vs.applied = append(vs.applied, plan)
 			ver = vs.vmap[plan.id]
 		} else {
 			vs.unapplied = append(vs.unapplied, plan)
-			ver = &Version{ID: plan.id}
-			vs.versions = append(vs.versions, ver)
+			ver = &Version{
+				ID:       plan.id,
+				Checksum: plan.checksum,
+			}
+			unapplied = append(unapplied, ver)
 			vs.vmap[ver.ID] = ver
 		}
 
-		if plan.up.dbFunc != nil {
-			ver.Up = "(DBFunc)"
-		} else if plan.up.txFunc != nil {
-			ver.Up = "(TxFunc)"
-		} else {
-			ver.Up = plan.up.sql
+		if ver.Description == "" {
+			ver.Description = plan.description
 		}
-		if plan.down.dbFunc != nil {
-			ver.Down = "(DBFunc)"
-		} else if plan.down.txFunc != nil {
-			ver.Down = "(TxFunc)"
-		} else {
-			ver.Down = plan.down.sql
+		if ver.Up == "" {
+			ver.Up = plan.up.description()
+			ver.Down = plan.downDescription(vs.dropStyle)
+		}
+		ver.NoTx = plan.noTx()
+	}
+
+	for i, j := 0, len(vs.applied)-1; i < j; i, j = i+1, j-1 {
+		vs.applied[i], vs.applied[j] = vs.applied[j], vs.applied[i]
+	}
+
+	// Dependencies can place plans out of ascending order.
+	if !sort.SliceIsSorted(unapplied, func(i, j int) bool {
+		return unapplied[i].ID < unapplied[j].ID
+	}) {
+		sort.Slice(unapplied, func(i, j int) bool {
+			return unapplied[i].ID < unapplied[j].ID
+		})
+	}
+	vs.versions = mergeVersions(vs.versions, unapplied)
+
+	return &vs, nil
+}
+
+// insertVersion inserts a row into the migrations table, using the
+// database clock for the applied time if specified by WithDatabaseClock.
+func (m *Worker) insertVersion(ctx context.Context, tx *sql.Tx, ver *Version) error {
+	var err error
+	if insert := m.versionFuncs.insert; insert != nil {
+		err = insert(ctx, tx, m.tableName(), ver)
+	} else if drv, ok := m.drv.(DatabaseClockDriver); ok && m.databaseClock && !m.versionFuncs.custom() {
+		err = drv.InsertVersionDatabaseClock(ctx, tx, m.tableName(), ver)
+	} else {
+		err = m.drv.InsertVersion(ctx, tx, m.tableName(), ver)
+	}
+	if err != nil {
+		return err
+	}
+	if drv, ok := m.drv.(StoredSQLDriver); ok && m.storedSQL {
+		if plan := m.planMap[ver.ID]; plan != nil {
+			up := plan.up.description()
+			down := plan.downDescription(m.dropStyle())
+			return drv.SetVersionSQL(ctx, tx, m.tableName(), ver.ID, up, down)
 		}
 	}
+	return nil
+}
+
+// deleteVersion deletes the row for version id from the migrations table.
+func (m *Worker) deleteVersion(ctx context.Context, tx *sql.Tx, id VersionID) error {
+	if del := m.versionFuncs.delete; del != nil {
+		return del(ctx, tx, m.tableName(), id)
+	}
+	return m.drv.DeleteVersion(ctx, tx, m.tableName(), id)
+}
 
-	sort.Slice(vs.applied, func(i, j int) bool {
-		return vs.applied[i].id > vs.applied[j].id
+// setVersionFailed sets the failed status of version id.
+func (m *Worker) setVersionFailed(ctx context.Context, tx *sql.Tx, id VersionID, failed bool) error {
+	if m.versionFuncs.update == nil {
+		return m.drv.SetVersionFailed(ctx, tx, m.tableName(), id, failed)
+	}
+	return m.updateVersion(ctx, tx, id, func(ver *Version) {
+		ver.Failed = failed
 	})
+}
 
-	sort.Slice(vs.unapplied, func(i, j int) bool {
-		return vs.unapplied[i].id < vs.unapplied[j].id
+// setVersionLocked sets the locked status of version id.
+func (m *Worker) setVersionLocked(ctx context.Context, tx *sql.Tx, id VersionID, locked bool) error {
+	if m.versionFuncs.update == nil {
+		return m.drv.SetVersionLocked(ctx, tx, m.tableName(), id, locked)
+	}
+	return m.updateVersion(ctx, tx, id, func(ver *Version) {
+		ver.Locked = locked
 	})
+}
 
-	sort.Slice(vs.versions, func(i, j int) bool {
-		return vs.versions[i].ID < vs.versions[j].ID
+// setVersionDuration sets the time taken to perform the up migration
+// for version id.
+func (m *Worker) setVersionDuration(ctx context.Context, tx *sql.Tx, id VersionID, d time.Duration) error {
+	if m.versionFuncs.update == nil {
+		return m.drv.SetVersionDuration(ctx, tx, m.tableName(), id, d)
+	}
+	return m.updateVersion(ctx, tx, id, func(ver *Version) {
+		ver.Duration = d
 	})
+}
 
-	return &vs, nil
+// updateVersion reads the row for version id from the migrations table,
+// changes it using fn, and writes it using the function specified by
+// WithUpdateVersionFunc. If there is no row for the version, nothing
+// is updated, which is consistent with the database drivers.
+func (m *Worker) updateVersion(ctx context.Context, tx *sql.Tx, id VersionID, fn func(ver *Version)) error {
+	versions, err := m.listVersions(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, ver := range versions {
+		if ver.ID == id {
+			fn(ver)
+			return m.versionFuncs.update(ctx, tx, m.tableName(), ver)
+		}
+	}
+	return nil
+}
+
+// latestVersion returns the highest version id in the schema.
+func (m *Worker) latestVersion() VersionID {
+	var id VersionID
+	for _, plan := range m.plans {
+		if plan.id > id {
+			id = plan.id
+		}
+	}
+	return id
+}
+
+// mergeVersions merges two lists of versions that are
+// in ascending order into a single list in ascending order.
+func mergeVersions(a, b []*Version) []*Version {
+	if len(b) == 0 {
+		return a
+	}
+	merged := make([]*Version, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if a[0].ID < b[0].ID {
+			merged = append(merged, a[0])
+			a = a[1:]
+		} else {
+			merged = append(merged, b[0])
+			b = b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
 }